@@ -0,0 +1,168 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+// tapp-hash prints hashes of templates in a TApp or PodTemplateSpec manifest. If an old manifest is given,
+// it also prints what tapp controller will do for pods of each template, so CI can predict the effect of
+// a change before merging it.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tappupdate/pkg/hash"
+
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+var (
+	file    string
+	oldFile string
+)
+
+const (
+	actionNone          = "None"
+	actionNew           = "New"
+	actionMetaUpdate    = "MetaUpdate"
+	actionInPlaceUpdate = "InPlaceUpdate"
+	actionRecreate      = "Recreate"
+)
+
+func main() {
+	pflag.StringVarP(&file, "filename", "f", "-", "TApp or PodTemplateSpec manifest in YAML or JSON, - for stdin")
+	pflag.StringVar(&oldFile, "old", "", "Old manifest to compare with, if set, the action for each template is printed")
+	pflag.Parse()
+
+	templates, err := readTemplates(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", file, err)
+		os.Exit(1)
+	}
+	var oldTemplates map[string]*corev1.PodTemplateSpec
+	if oldFile != "" {
+		if oldTemplates, err = readTemplates(oldFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", oldFile, err)
+			os.Exit(1)
+		}
+	}
+	printHashes(os.Stdout, templates, oldTemplates)
+}
+
+// readTemplates returns templates with hashes in manifest file. For a TApp, they are its default template and
+// templates in templatePool; for a PodTemplateSpec, it is the template itself named by default template name.
+func readTemplates(file string) (map[string]*corev1.PodTemplateSpec, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	typeMeta := metav1.TypeMeta{}
+	if err := decode(data, &typeMeta); err != nil {
+		return nil, err
+	}
+	templates := make(map[string]*corev1.PodTemplateSpec)
+	switch typeMeta.Kind {
+	case "TApp":
+		tapp := &tappv1.TApp{}
+		if err := decode(data, tapp); err != nil {
+			return nil, err
+		}
+		templates[tappv1.DefaultTemplateName] = &tapp.Spec.Template
+		for name := range tapp.Spec.TemplatePool {
+			template := tapp.Spec.TemplatePool[name]
+			templates[name] = &template
+		}
+	case "":
+		template := &corev1.PodTemplateSpec{}
+		if err := decode(data, template); err != nil {
+			return nil, err
+		}
+		templates[tappv1.DefaultTemplateName] = template
+	default:
+		return nil, fmt.Errorf("unsupported kind %s, expected TApp or PodTemplateSpec", typeMeta.Kind)
+	}
+
+	tappHash := hash.NewTappHash()
+	for _, template := range templates {
+		// Update hashes the same way as the job and tapp controller do, labels in manifest are kept as they are.
+		hash.UpdateHashes(tappHash, template)
+	}
+	return templates, nil
+}
+
+func decode(data []byte, into interface{}) error {
+	return yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096).Decode(into)
+}
+
+func printHashes(out io.Writer, templates, oldTemplates map[string]*corev1.PodTemplateSpec) {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tappHash := hash.NewTappHash()
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+	if oldTemplates == nil {
+		fmt.Fprintln(w, "TEMPLATE\tTEMPLATE_HASH\tUNIQ_HASH\tSPEC_HASH")
+	} else {
+		fmt.Fprintln(w, "TEMPLATE\tTEMPLATE_HASH\tUNIQ_HASH\tSPEC_HASH\tACTION")
+	}
+	for _, name := range names {
+		labels := templates[name].Labels
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s", name, tappHash.GetTemplateHash(labels), tappHash.GetUniqHash(labels),
+			tappHash.GetSpecHash(labels))
+		if oldTemplates != nil {
+			fmt.Fprintf(w, "\t%s", getAction(tappHash, oldTemplates[name], templates[name]))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// getAction returns what tapp controller will do for pods created from oldTemplate when it changes to template.
+func getAction(tappHash hash.TappHashInterface, oldTemplate, template *corev1.PodTemplateSpec) string {
+	switch {
+	case oldTemplate == nil:
+		return actionNew
+	case tappHash.GetTemplateHash(oldTemplate.Labels) == tappHash.GetTemplateHash(template.Labels):
+		return actionNone
+	case tappHash.GetUniqHash(oldTemplate.Labels) != tappHash.GetUniqHash(template.Labels):
+		return actionRecreate
+	case tappHash.GetSpecHash(oldTemplate.Labels) != tappHash.GetSpecHash(template.Labels):
+		return actionInPlaceUpdate
+	default:
+		return actionMetaUpdate
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tappupdate/pkg/hash"
+	pkgtesting "tkestack.io/tappupdate/pkg/testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func createTemplate() *corev1.PodTemplateSpec {
+	template := pkgtesting.NewTemplate(map[string]string{"app": "test"}, "nginx:1")
+	template.Spec.Containers[0].Args = []string{"a"}
+	return &template
+}
+
+// hashTemplate returns template with hashes set by tapp controller.
+func hashTemplate(template *corev1.PodTemplateSpec) *corev1.PodTemplateSpec {
+	return &pkgtesting.NewTApp("default", "test", 1, *template).Spec.Template
+}
+
+func TestGetAction(t *testing.T) {
+	tappHash := hash.NewTappHash()
+	tests := []struct {
+		name   string
+		old    func() *corev1.PodTemplateSpec
+		mutate func(template *corev1.PodTemplateSpec)
+		action string
+	}{
+		{
+			name:   "new template",
+			old:    func() *corev1.PodTemplateSpec { return nil },
+			mutate: func(template *corev1.PodTemplateSpec) {},
+			action: actionNew,
+		},
+		{
+			name:   "not changed",
+			old:    createTemplate,
+			mutate: func(template *corev1.PodTemplateSpec) {},
+			action: actionNone,
+		},
+		{
+			name:   "labels changed",
+			old:    createTemplate,
+			mutate: func(template *corev1.PodTemplateSpec) { template.Labels["version"] = "2" },
+			action: actionMetaUpdate,
+		},
+		{
+			name:   "image changed",
+			old:    createTemplate,
+			mutate: func(template *corev1.PodTemplateSpec) { template.Spec.Containers[0].Image = "nginx:2" },
+			action: actionInPlaceUpdate,
+		},
+		{
+			name:   "args changed",
+			old:    createTemplate,
+			mutate: func(template *corev1.PodTemplateSpec) { template.Spec.Containers[0].Args = []string{"b"} },
+			action: actionRecreate,
+		},
+	}
+	for _, test := range tests {
+		old := test.old()
+		if old != nil {
+			old = hashTemplate(old)
+		}
+		template := createTemplate()
+		test.mutate(template)
+		template = hashTemplate(template)
+		if action := getAction(tappHash, old, template); action != test.action {
+			t.Errorf("%s: expected action %s, got %s", test.name, test.action, action)
+		}
+	}
+}
+
+func TestReadTemplates(t *testing.T) {
+	const manifest = `
+apiVersion: apps.tkestack.io/v1
+kind: TApp
+metadata:
+  name: test
+spec:
+  template:
+    metadata:
+      labels:
+        app: test
+    spec:
+      containers:
+      - name: main
+        image: nginx:1
+  templatePool:
+    canary:
+      metadata:
+        labels:
+          app: test
+          tapp_template_hash_key: stale
+          tapp_uniq_hash_key: stale
+          tapp_spec_hash_key: stale
+      spec:
+        containers:
+        - name: main
+          image: nginx:2
+`
+	file := writeManifest(t, manifest)
+	defer os.Remove(file)
+	templates, err := readTemplates(file)
+	if err != nil {
+		t.Fatalf("Failed to read templates: %v", err)
+	}
+	if len(templates) != 2 {
+		t.Fatalf("Expected 2 templates, got %d", len(templates))
+	}
+
+	tappHash := hash.NewTappHash()
+	expected := &corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{
+			"app":                    "test",
+			"tapp_template_hash_key": "stale",
+			"tapp_uniq_hash_key":     "stale",
+			"tapp_spec_hash_key":     "stale",
+		}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "main", Image: "nginx:2"}}},
+	}
+	// Hashes are updated from labels in manifest as they are, the same as updateTemplateHash of the job.
+	hash.UpdateHashes(tappHash, expected)
+	for _, key := range tappHash.HashLabels() {
+		if value := templates["canary"].Labels[key]; value != expected.Labels[key] {
+			t.Errorf("Expected label %s=%s, got %s", key, expected.Labels[key], value)
+		}
+	}
+	if action := getAction(tappHash, templates[tappv1.DefaultTemplateName], templates["canary"]); action != actionInPlaceUpdate {
+		t.Errorf("Expected action %s between default and canary templates, got %s", actionInPlaceUpdate, action)
+	}
+}
+
+func TestReadTemplatesUnsupportedKind(t *testing.T) {
+	file := writeManifest(t, "apiVersion: v1\nkind: Pod\n")
+	defer os.Remove(file)
+	if _, err := readTemplates(file); err == nil {
+		t.Errorf("Expected error for unsupported kind")
+	}
+}
+
+func writeManifest(t *testing.T, manifest string) string {
+	f, err := ioutil.TempFile("", "tapp-hash")
+	if err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(manifest); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	return f.Name()
+}
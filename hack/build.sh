@@ -18,7 +18,8 @@ else
 fi
 
 cd $ROOT
-CGO_ENABLED=0 go build -o bin/tapp-update-check -ldflags "$(api::version::ldflags)" .
+CGO_ENABLED=0 go build -o bin/tapp-update-check -ldflags "$(api::version::ldflags)" . && \
+  CGO_ENABLED=0 go build -o bin/tapp-hash -ldflags "$(api::version::ldflags)" ./cmd/tapp-hash
 if [ $? -eq 0 ]; then
   echo "Build success!"
 else
@@ -20,6 +20,10 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	clientset "tkestack.io/tapp/pkg/client/clientset/versioned"
@@ -28,8 +32,11 @@ import (
 	"tkestack.io/tappupdate/pkg/tappupdate"
 
 	"github.com/spf13/pflag"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/component-base/logs"
 	"k8s.io/klog"
@@ -42,27 +49,63 @@ var (
 	kubeAPIQPS float32
 	// kubeAPIBurst is the burst to use while talking with kubernetes apiserver.
 	kubeAPIBurst int
+	// kubeAPIContentType is the content type of requests sent to kubernetes apiserver for built-in resources.
+	kubeAPIContentType string
 	// TApp sync worker number
 	worker int
 
-	namespace string
-	name      string
+	namespace  string
+	namespaces []string
+	name       string
 
 	updateRetries int
+	// Number of instances of a tapp processed in parallel
+	instanceWorkers int
+
+	dryRun         bool
+	gcTemplatePool bool
+	adoptPods      bool
+
+	// allowWatchBookmarks requests watch bookmarks from kubernetes apiserver.
+	allowWatchBookmarks bool
+
+	// Tapps are split into shardCount shards, only tapps of shard shardIndex are handled.
+	shardCount int
+	shardIndex int
+
+	skipPreflight bool
 )
 
 const (
-	defaultWorkerNumber  = 5
-	defaultKubeAPIQPS    = 2000
-	defaultKubeAPIBurst  = 2500
-	defaultUpdateRetries = 3
+	defaultWorkerNumber    = 5
+	defaultKubeAPIQPS      = 2000
+	defaultKubeAPIBurst    = 2500
+	defaultUpdateRetries   = 3
+	defaultInstanceWorkers = 10
+
+	defaultKubeAPIContentType = "application/vnd.kubernetes.protobuf"
 )
 
 func main() {
+	if namespace != "" && len(namespaces) != 0 {
+		klog.Fatalf("only one of namespace and namespaces can be set")
+		return
+	}
 	if namespace == "" && name != "" {
 		klog.Fatalf("namespace must be set for name is set")
 		return
 	}
+	if instanceWorkers < 1 {
+		klog.Fatalf("instance-workers must be at least 1, got %d", instanceWorkers)
+		return
+	}
+	if shardCount < 1 || shardIndex < 0 || shardIndex >= shardCount {
+		klog.Fatalf("shard-index must be in [0, shard-count), got shard-count %d, shard-index %d", shardCount, shardIndex)
+		return
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{namespace}
+	}
 	cfg, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
 	if err != nil {
 		klog.Fatalf("Error building kubeconfig: %s", err.Error())
@@ -70,7 +113,11 @@ func main() {
 	cfg.QPS = kubeAPIQPS
 	cfg.Burst = kubeAPIBurst
 
-	kubeClient, err := kubernetes.NewForConfig(cfg)
+	// Custom resources do not support protobuf, so only the client of built-in resources uses kubeAPIContentType.
+	kubeCfg := rest.CopyConfig(cfg)
+	kubeCfg.ContentType = kubeAPIContentType
+	kubeCfg.AcceptContentTypes = kubeAPIContentType + ",application/json"
+	kubeClient, err := kubernetes.NewForConfig(kubeCfg)
 	if err != nil {
 		klog.Fatalf("Error building kubernetes clientset: %s", err.Error())
 	}
@@ -80,20 +127,74 @@ func main() {
 		klog.Fatalf("Error building example clientset: %s", err.Error())
 	}
 
-	kubeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30, kubeinformers.WithNamespace(namespace))
-	tappInformerFactory := informers.NewSharedInformerFactoryWithOptions(tappClient, time.Second*30, informers.WithNamespace(namespace))
-
-	controller := tappupdate.NewController(kubeClient, tappClient, kubeInformerFactory, tappInformerFactory, updateRetries)
+	tappupdate.SetDryRun(dryRun)
+	tappupdate.SetGCTemplatePool(gcTemplatePool)
+	tappupdate.SetAdoptOrphanPods(adoptPods)
+	tappupdate.SetShard(shardCount, shardIndex)
 	run := func(ctx context.Context) {
-		stop := ctx.Done()
-
-		go kubeInformerFactory.Start(stop)
-		go tappInformerFactory.Start(stop)
-		if err = controller.Run(worker, namespace, name, stop); err != nil {
-			klog.Fatalf("Error running controller: %s", err.Error())
+		// Check all namespaces before handling any, so a namespace missing permissions doesn't leave others half done.
+		if !skipPreflight {
+			for _, ns := range namespaces {
+				if err = tappupdate.Preflight(kubeClient, ns); err != nil {
+					klog.Fatalf("Preflight check failed in namespace %q: %s", ns, err.Error())
+				}
+			}
+		}
+		// A failed namespace doesn't stop others from being handled, the job fails when all namespaces are handled.
+		var errs []error
+		for _, ns := range namespaces {
+			if ctx.Err() != nil {
+				errs = append(errs, fmt.Errorf("stopped before all namespaces are handled"))
+				break
+			}
+			if err := runInNamespace(ctx, kubeClient, tappClient, ns); err != nil {
+				klog.Errorf("Error running controller in namespace %q: %s", ns, err.Error())
+				errs = append(errs, fmt.Errorf("namespace %q: %v", ns, err))
+			}
+		}
+		if len(errs) != 0 {
+			klog.Fatalf("Failed to handle tapps: %s", utilerrors.NewAggregate(errs).Error())
 		}
 	}
-	run(context.TODO())
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-sigCh
+		klog.Info("Received termination signal, finishing in-flight operations")
+		cancel()
+		// Exit directly on the second signal.
+		<-sigCh
+		os.Exit(1)
+	}()
+	run(ctx)
+}
+
+// runInNamespace handles tapps in namespace, all namespaces if namespace is empty.
+func runInNamespace(ctx context.Context, kubeClient kubernetes.Interface, tappClient clientset.Interface,
+	namespace string) error {
+	// Informers of this namespace are stopped once it is handled.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := ctx.Done()
+
+	kubeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30,
+		kubeinformers.WithNamespace(namespace), kubeinformers.WithTweakListOptions(tweakListOptions))
+	tappInformerFactory := informers.NewSharedInformerFactoryWithOptions(tappClient, time.Second*30,
+		informers.WithNamespace(namespace), informers.WithTweakListOptions(tweakListOptions))
+	controller := tappupdate.NewController(kubeClient, tappClient, kubeInformerFactory, tappInformerFactory,
+		updateRetries, instanceWorkers)
+
+	go kubeInformerFactory.Start(stop)
+	go tappInformerFactory.Start(stop)
+	return controller.Run(worker, namespace, name, stop)
+}
+
+// tweakListOptions applies watch tuning flags to requests of informers.
+func tweakListOptions(options *metav1.ListOptions) {
+	if options.Watch {
+		options.AllowWatchBookmarks = allowWatchBookmarks
+	}
 }
 
 func init() {
@@ -113,8 +214,25 @@ func addFlags(fs *pflag.FlagSet) {
 		"The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
 	fs.Float32Var(&kubeAPIQPS, "kube-api-qps", defaultKubeAPIQPS, "QPS to use while talking with kubernetes apiserver")
 	fs.IntVar(&kubeAPIBurst, "kube-api-burst", defaultKubeAPIBurst, "Burst to use while talking with kubernetes apiserver")
+	fs.StringVar(&kubeAPIContentType, "kube-api-content-type", defaultKubeAPIContentType,
+		"Content type of requests sent to kubernetes apiserver for built-in resources like pods and events")
 	fs.IntVar(&worker, "worker", defaultWorkerNumber, "TApp sync worker number, default: 5")
 	fs.StringVar(&namespace, "namespace", "", "The namespace to handle on")
+	fs.StringSliceVar(&namespaces, "namespaces", nil,
+		"Comma separated namespaces to handle on, they are handled one by one, can't be used with namespace")
 	fs.StringVar(&name, "name", "", "The name of tapp to handle on")
 	fs.IntVar(&updateRetries, "updateRetries", defaultUpdateRetries, "the number of Get/Update cycles we perform when an update fails, deault 3")
+	fs.IntVar(&instanceWorkers, "instance-workers", defaultInstanceWorkers,
+		"Number of instances of a tapp processed in parallel, default: 10")
+	fs.BoolVar(&dryRun, "dry-run", false, "Only print the planned action for each instance, without patching any pod")
+	fs.BoolVar(&gcTemplatePool, "gc-template-pool", true,
+		"Delete templatePool entries which are not referenced by any instance and not used by any pod")
+	fs.BoolVar(&adoptPods, "adopt-orphan-pods", false,
+		"Adopt pods which match tapp's selector and instance id but have no controller, without restarting them")
+	fs.BoolVar(&allowWatchBookmarks, "allow-watch-bookmarks", false,
+		"Request watch bookmarks from kubernetes apiserver, so watches can be resumed without relisting")
+	fs.IntVar(&shardCount, "shard-count", 1, "Number of shards tapps are split into, each handled by a separate job")
+	fs.IntVar(&shardIndex, "shard-index", 0, "Index of the shard handled by this job, in [0, shard-count)")
+	fs.BoolVar(&skipPreflight, "skip-preflight", false,
+		"Skip checking TApp CRD and RBAC permissions before handling tapps")
 }
@@ -20,6 +20,7 @@ package hash
 import (
 	"fmt"
 	"hash/fnv"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	hashutil "k8s.io/kubernetes/pkg/util/hash"
@@ -38,6 +39,13 @@ const (
 	// It will will be used to check whether pod's PodTemplateSpec hash changed and only meta
 	// changed, if yes, we will do update for the pod.
 	SpecHashKey = "tapp_spec_hash_key"
+
+	// SchemeAnnotationKey is a key for storing the version of hash scheme in tapp's annotations.
+	// A tapp whose hash labels are generated by a newer scheme must not be handled, or its pods
+	// will be regarded as changed.
+	SchemeAnnotationKey = "tkestack.io/tapp-hash-scheme"
+	// SchemeVersion is the version of the hash scheme, it must be increased once generation of any hash changes.
+	SchemeVersion = 1
 )
 
 // TappHashInterface is used for generate and verify hash for tapp.
@@ -61,6 +69,16 @@ type TappHashInterface interface {
 	HashLabels() []string
 }
 
+// UpdateHashes sets hashes of template into its labels in the same way as tapp controller: uniq hash is only
+// updated if template hash changed, and spec hash is only updated if uniq hash changed.
+func UpdateHashes(th TappHashInterface, template *corev1.PodTemplateSpec) {
+	if th.SetTemplateHash(template) {
+		if th.SetUniqHash(template) {
+			th.SetSpecHash(template)
+		}
+	}
+}
+
 func NewTappHash() TappHashInterface {
 	return &defaultTappHash{}
 }
@@ -132,16 +150,25 @@ func generateHash(template interface{}) uint64 {
 }
 
 func generateTemplateHash(template *corev1.PodTemplateSpec) string {
-	meta := template.ObjectMeta.DeepCopy()
-	delete(meta.Labels, TemplateHashKey)
-	delete(meta.Labels, UniqHashKey)
+	defer observeComputation(TemplateHashType, time.Now())
+	// Only labels are modified, so there is no need to deep copy the whole meta.
+	meta := template.ObjectMeta
+	if template.Labels != nil {
+		meta.Labels = make(map[string]string, len(template.Labels))
+		for k, v := range template.Labels {
+			if k != TemplateHashKey && k != UniqHashKey {
+				meta.Labels[k] = v
+			}
+		}
+	}
 	return fmt.Sprintf("%d", generateHash(corev1.PodTemplateSpec{
-		ObjectMeta: *meta,
+		ObjectMeta: meta,
 		Spec:       template.Spec,
 	}))
 }
 
 func generateUniqHash(template corev1.PodTemplateSpec) string {
+	defer observeComputation(UniqHashType, time.Now())
 	if template.Spec.InitContainers != nil {
 		var newContainers []corev1.Container
 		for _, container := range template.Spec.InitContainers {
@@ -162,5 +189,6 @@ func generateUniqHash(template corev1.PodTemplateSpec) string {
 }
 
 func generateSpecHash(template corev1.PodTemplateSpec) string {
+	defer observeComputation(SpecHashType, time.Now())
 	return fmt.Sprintf("%d", generateHash(template.Spec))
 }
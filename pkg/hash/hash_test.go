@@ -18,6 +18,7 @@
 package hash
 
 import (
+	"fmt"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -60,6 +61,34 @@ func TestSetSpecHash(t *testing.T) {
 	}
 }
 
+func TestGenerateTemplateHashIgnoresHashLabels(t *testing.T) {
+	template := createPodTemplate()
+	expected := generateTemplateHash(&template)
+
+	template.Labels[TemplateHashKey] = "template"
+	template.Labels[UniqHashKey] = "uniq"
+	if hash := generateTemplateHash(&template); hash != expected {
+		t.Errorf("Expected template hash %s, got %s", expected, hash)
+	}
+	if template.Labels[TemplateHashKey] != "template" || template.Labels[UniqHashKey] != "uniq" {
+		t.Errorf("Labels of template should not be modified")
+	}
+
+	template.Labels = nil
+	meta := template.ObjectMeta.DeepCopy()
+	expected = fmt.Sprintf("%d", generateHash(corev1.PodTemplateSpec{ObjectMeta: *meta, Spec: template.Spec}))
+	if hash := generateTemplateHash(&template); hash != expected {
+		t.Errorf("Expected template hash %s for nil labels, got %s", expected, hash)
+	}
+}
+
+func BenchmarkGenerateTemplateHash(b *testing.B) {
+	template := createPodTemplate()
+	for i := 0; i < b.N; i++ {
+		generateTemplateHash(&template)
+	}
+}
+
 func createPodTemplate() corev1.PodTemplateSpec {
 	return corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
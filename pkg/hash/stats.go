@@ -0,0 +1,84 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package hash
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// TemplateHashType is the hash type of TemplateHashKey.
+	TemplateHashType = "template"
+	// UniqHashType is the hash type of UniqHashKey.
+	UniqHashType = "uniq"
+	// SpecHashType is the hash type of SpecHashKey.
+	SpecHashType = "spec"
+)
+
+// ComputationStats is the statistics of computations of one hash type.
+type ComputationStats struct {
+	// Count is the number of computations.
+	Count int64
+	// Duration is the total duration of computations.
+	Duration time.Duration
+	// MaxDuration is the longest duration of a computation.
+	MaxDuration time.Duration
+}
+
+var (
+	statsLock sync.Mutex
+	stats     = make(map[string]ComputationStats)
+)
+
+// observeComputation records a computation of hashType which starts at start.
+func observeComputation(hashType string, start time.Time) {
+	duration := time.Since(start)
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	s := stats[hashType]
+	s.Count++
+	s.Duration += duration
+	if duration > s.MaxDuration {
+		s.MaxDuration = duration
+	}
+	stats[hashType] = s
+}
+
+// GetComputationStats returns statistics of computations by hash type since the process starts.
+func GetComputationStats() map[string]ComputationStats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	result := make(map[string]ComputationStats, len(stats))
+	for hashType, s := range stats {
+		result[hashType] = s
+	}
+	return result
+}
+
+// GetComputationCount returns the total number of computations of all hash types.
+func GetComputationCount() int64 {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	var count int64
+	for _, s := range stats {
+		count += s.Count
+	}
+	return count
+}
@@ -0,0 +1,133 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"encoding/json"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tapp/pkg/util"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+// adoptOrphanPods adopts pods that match tapp's selector but have no controller, e.g. pods created by a legacy
+// system. Only pods of desired running instances that have no owned pod yet are adopted. If a pod conforms to its
+// instance's template, hash labels of the template are set into it so it will not be recreated, otherwise it is
+// adopted without hash labels and tapp controller will reconcile it. Hashes of tapp's templates must have been
+// updated. It returns the adopted pods.
+func (c *Controller) adoptOrphanPods(tapp *tappv1.TApp) []*corev1.Pod {
+	// The same as ClaimPods, a tapp being deleted should not adopt pods.
+	if tapp.DeletionTimestamp != nil {
+		return nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(tapp.Spec.Selector)
+	if err != nil {
+		klog.Errorf("Failed to get selector of tapp %s: %v", util.GetTAppFullName(tapp), err)
+		return nil
+	}
+	pods, err := c.podStore.Pods(tapp.Namespace).List(sel)
+	if err != nil {
+		klog.Errorf("Failed to list pods for tapp %s: %v", util.GetTAppFullName(tapp), err)
+		return nil
+	}
+
+	adoptedIds := sets.NewString()
+	desiredRunningPods := getDesiredInstance(tapp)
+
+	var (
+		adopted   []*corev1.Pod
+		failedIds []string
+		errs      []error
+	)
+	for _, pod := range pods {
+		if metav1.GetControllerOf(pod) != nil || pod.DeletionTimestamp != nil {
+			continue
+		}
+		id, err := getPodIndex(pod)
+		if err != nil {
+			klog.V(4).Infof("Orphan pod %s matches the selector of tapp %s, but has no instance id",
+				getPodFullName(pod), util.GetTAppFullName(tapp))
+			continue
+		}
+		owned, err := podsByIndex(c.podIndexer, podInstanceIndex, instanceIndexKey(tapp.UID, id))
+		if err != nil {
+			klog.Errorf("Failed to get pods of instance %s of tapp %s: %v", id, util.GetTAppFullName(tapp), err)
+			continue
+		}
+		if !desiredRunningPods.Has(id) || len(owned) != 0 || adoptedIds.Has(id) {
+			klog.V(4).Infof("Orphan pod %s matches the selector of tapp %s, but instance %s is not available",
+				getPodFullName(pod), util.GetTAppFullName(tapp), id)
+			continue
+		}
+		if isDryRun(tapp) {
+			klog.Infof("[dry-run] tapp %s, pod %s will be adopted as instance %s", util.GetTAppFullName(tapp),
+				getPodFullName(pod), id)
+			continue
+		}
+		if newPod, err := c.adoptPod(tapp, id, pod); err != nil {
+			klog.Errorf("Failed to adopt pod %s for tapp %s: %v", getPodFullName(pod), util.GetTAppFullName(tapp), err)
+			failedIds = append(failedIds, id)
+			errs = append(errs, err)
+		} else {
+			adoptedIds.Insert(id)
+			adopted = append(adopted, newPod)
+		}
+	}
+	c.recordInstancesEvent(tapp, corev1.EventTypeNormal, "Adopted", "Adopted orphan pods", adoptedIds.List())
+	c.recordInstancesErrors(tapp, "AdoptFailed", "Failed to adopt orphan pods", failedIds, errs)
+	return adopted
+}
+
+// adoptPod sets tapp as controller of pod, and sets hash labels of instance's template into pod if pod conforms
+// to the template.
+func (c *Controller) adoptPod(tapp *tappv1.TApp, id string, pod *corev1.Pod) (*corev1.Pod, error) {
+	template, err := getPodTemplate(&tapp.Spec, id)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string)
+	if isPodConformant(pod, template) {
+		for _, key := range hashLabelKeys {
+			if value := template.Labels[key]; value != "" {
+				labels[key] = value
+			}
+		}
+	} else {
+		klog.Infof("Pod %s does not conform to the template of instance %s of tapp %s, adopt it without hash labels",
+			getPodFullName(pod), id, util.GetTAppFullName(tapp))
+	}
+	patchData := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metav1.OwnerReference{
+				*metav1.NewControllerRef(tapp, tappv1.SchemeGroupVersion.WithKind("TApp")),
+			},
+			"labels": labels,
+			// uid makes sure we patch the very pod we found.
+			"uid": pod.UID,
+		},
+	}
+	playLoadBytes, _ := json.Marshal(patchData)
+	klog.V(3).Infof("adopt pod %s as instance %s of tapp %s", getPodFullName(pod), id, util.GetTAppFullName(tapp))
+
+	return c.kubeclient.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.StrategicMergePatchType, playLoadBytes)
+}
@@ -0,0 +1,172 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tappupdate
+
+import (
+	"testing"
+
+	v1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	pkgtesting "tkestack.io/tappupdate/pkg/testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func createAdoptionTApp() *v1.TApp {
+	return pkgtesting.NewTApp("default", "test", 3, createTemplate("v1"))
+}
+
+// createOrphanPod returns pod of instance id of tapp running image, which has no controller or hash labels.
+func createOrphanPod(t *testing.T, tapp *v1.TApp, id, image string) *corev1.Pod {
+	pod := mustNewPod(t, tapp, id)
+	pod.OwnerReferences = nil
+	for _, key := range hashLabelKeys {
+		delete(pod.Labels, key)
+	}
+	pod.Spec.Containers[0].Image = image
+	return pod
+}
+
+func TestAdoptOrphanPods(t *testing.T) {
+	defer SetAdoptOrphanPods(false)
+	SetAdoptOrphanPods(true)
+
+	tapp := createAdoptionTApp()
+	conformant := createOrphanPod(t, tapp, "0", "v1")
+	nonConformant := createOrphanPod(t, tapp, "1", "v0")
+	controlled := createOrphanPod(t, tapp, "2", "v1")
+	controlled.OwnerReferences = []metav1.OwnerReference{
+		*metav1.NewControllerRef(&v1.TApp{ObjectMeta: metav1.ObjectMeta{Name: "other", UID: "other"}},
+			v1.SchemeGroupVersion.WithKind("TApp")),
+	}
+	c, kubeclient, _ := newTestController([]*corev1.Pod{conformant, nonConformant, controlled})
+
+	adopted := c.adoptOrphanPods(tapp)
+	if len(adopted) != 2 {
+		t.Fatalf("Expected 2 pods to be adopted, got %d", len(adopted))
+	}
+
+	for _, test := range []struct {
+		name       string
+		hashLabels bool
+	}{
+		{name: conformant.Name, hashLabels: true},
+		{name: nonConformant.Name, hashLabels: false},
+	} {
+		pod, err := kubeclient.CoreV1().Pods("default").Get(test.name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get pod %s: %v", test.name, err)
+		}
+		if ref := metav1.GetControllerOf(pod); ref == nil || ref.UID != tapp.UID {
+			t.Errorf("Expected pod %s to be controlled by tapp, got %v", test.name, ref)
+		}
+		for _, key := range hashLabelKeys {
+			value, ok := pod.Labels[key]
+			if test.hashLabels && value != tapp.Spec.Template.Labels[key] {
+				t.Errorf("Expected pod %s to have label %s=%s, got %q", test.name, key,
+					tapp.Spec.Template.Labels[key], value)
+			}
+			if !test.hashLabels && ok {
+				t.Errorf("Expected pod %s to have no label %s", test.name, key)
+			}
+		}
+	}
+
+	pod, err := kubeclient.CoreV1().Pods("default").Get(controlled.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get pod %s: %v", controlled.Name, err)
+	}
+	if ref := metav1.GetControllerOf(pod); ref == nil || ref.UID != "other" {
+		t.Errorf("Expected pod %s to be kept controlled by its controller, got %v", controlled.Name, ref)
+	}
+}
+
+func TestAdoptOrphanPodsDeletingTApp(t *testing.T) {
+	tapp := createAdoptionTApp()
+	now := metav1.Now()
+	tapp.DeletionTimestamp = &now
+	c, kubeclient, _ := newTestController([]*corev1.Pod{createOrphanPod(t, tapp, "0", "v1")})
+
+	if adopted := c.adoptOrphanPods(tapp); len(adopted) != 0 {
+		t.Errorf("Expected no pod to be adopted by a deleting tapp, got %d", len(adopted))
+	}
+	for _, action := range kubeclient.Actions() {
+		if action.GetVerb() == "patch" {
+			t.Errorf("Unexpected patch: %v", action)
+		}
+	}
+}
+
+func TestIsPodConformant(t *testing.T) {
+	tapp := createAdoptionTApp()
+	template := &tapp.Spec.Template
+	tests := []struct {
+		name   string
+		mutate func(pod *corev1.Pod)
+		expect bool
+	}{
+		{name: "conformant", mutate: func(pod *corev1.Pod) {}, expect: true},
+		{name: "different image", mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].Image = "v0" }},
+		{name: "different container", mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].Name = "other" }},
+		{name: "extra container", mutate: func(pod *corev1.Pod) {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: "v1"})
+		}},
+		{name: "missing label", mutate: func(pod *corev1.Pod) { delete(pod.Labels, "template") }},
+		{name: "different label", mutate: func(pod *corev1.Pod) { pod.Labels["template"] = "v0" }},
+		{name: "different resources", mutate: func(pod *corev1.Pod) {
+			pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{
+				corev1.ResourceCPU: resource.MustParse("1"),
+			}
+		}},
+		{name: "different env", mutate: func(pod *corev1.Pod) {
+			pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "key", Value: "value"}}
+		}},
+		{name: "different command", mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].Command = []string{"sh"} }},
+		{name: "different volumes", mutate: func(pod *corev1.Pod) {
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "data"})
+		}},
+		{name: "different node selector", mutate: func(pod *corev1.Pod) {
+			pod.Spec.NodeSelector = map[string]string{"zone": "a"}
+		}},
+		{name: "defaulted fields", expect: true, mutate: func(pod *corev1.Pod) {
+			pod.Spec.NodeName = "node"
+			pod.Spec.RestartPolicy = corev1.RestartPolicyAlways
+			pod.Spec.Containers[0].ImagePullPolicy = corev1.PullIfNotPresent
+		}},
+		{name: "service account token", expect: true, mutate: func(pod *corev1.Pod) {
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "default-token-abcde",
+				VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "default-token-abcde"}}})
+			pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts,
+				corev1.VolumeMount{Name: "default-token-abcde", MountPath: serviceAccountMountPath, ReadOnly: true})
+		}},
+		{name: "default tolerations", expect: true, mutate: func(pod *corev1.Pod) {
+			seconds := int64(300)
+			for _, key := range defaultTolerationKeys.List() {
+				pod.Spec.Tolerations = append(pod.Spec.Tolerations, corev1.Toleration{Key: key,
+					Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute, TolerationSeconds: &seconds})
+			}
+		}},
+	}
+	for _, test := range tests {
+		pod := createOrphanPod(t, tapp, "0", "v1")
+		test.mutate(pod)
+		if result := isPodConformant(pod, template); result != test.expect {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expect, result)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tappupdate
+
+import (
+	"reflect"
+
+	"tkestack.io/tappupdate/pkg/hash"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// serviceAccountMountPath is where service account admission mounts the token volume into containers.
+	serviceAccountMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// hashLabelKeys are keys of labels that store hashes of template.
+var hashLabelKeys = []string{hash.TemplateHashKey, hash.UniqHashKey, hash.SpecHashKey}
+
+// defaultedFields are fields of pod spec that may be set by apiserver defaulting, admission plugins or scheduler,
+// a pod may have them even if its template doesn't.
+var defaultedFields = sets.NewString(
+	// Pod
+	"dnsPolicy", "enableServiceLinks", "nodeName", "preemptionPolicy", "priority", "restartPolicy", "schedulerName",
+	"securityContext", "serviceAccount", "serviceAccountName", "terminationGracePeriodSeconds",
+	// Container
+	"imagePullPolicy", "terminationMessagePath", "terminationMessagePolicy",
+	// Port
+	"protocol",
+	// Probe and handler
+	"failureThreshold", "periodSeconds", "scheme", "successThreshold", "timeoutSeconds",
+	// Volume and downward API
+	"apiVersion", "defaultMode",
+)
+
+// defaultTolerationKeys are keys of tolerations added by DefaultTolerationSeconds admission plugin.
+var defaultTolerationKeys = sets.NewString("node.kubernetes.io/not-ready", "node.kubernetes.io/unreachable")
+
+// isPodConformant returns true if pod is created from template: it has all labels and annotations of template
+// except hash labels, and its spec is the same as template's, except fields set by apiserver defaulting, admission
+// plugins or scheduler that are not set in template.
+func isPodConformant(pod *corev1.Pod, template *corev1.PodTemplateSpec) bool {
+	hashKeys := sets.NewString(hashLabelKeys...)
+	for key, value := range template.Labels {
+		if hashKeys.Has(key) {
+			continue
+		}
+		if podValue, ok := pod.Labels[key]; !ok || podValue != value {
+			return false
+		}
+	}
+	for key, value := range template.Annotations {
+		if podValue, ok := pod.Annotations[key]; !ok || podValue != value {
+			return false
+		}
+	}
+
+	spec := pod.Spec.DeepCopy()
+	removeInjectedFields(spec, &template.Spec)
+	actual, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
+	if err != nil {
+		return false
+	}
+	expected, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&template.Spec)
+	if err != nil {
+		return false
+	}
+	return isConformant(expected, actual)
+}
+
+// removeInjectedFields removes service account token volume and default tolerations from spec, if they are not
+// in template.
+func removeInjectedFields(spec, template *corev1.PodSpec) {
+	templateVolumes := sets.NewString()
+	for _, volume := range template.Volumes {
+		templateVolumes.Insert(volume.Name)
+	}
+	injected := sets.NewString()
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			mounts := containers[i].VolumeMounts[:0]
+			for _, mount := range containers[i].VolumeMounts {
+				if mount.MountPath == serviceAccountMountPath && !templateVolumes.Has(mount.Name) {
+					injected.Insert(mount.Name)
+					continue
+				}
+				mounts = append(mounts, mount)
+			}
+			containers[i].VolumeMounts = mounts
+		}
+	}
+	volumes := spec.Volumes[:0]
+	for _, volume := range spec.Volumes {
+		if !injected.Has(volume.Name) {
+			volumes = append(volumes, volume)
+		}
+	}
+	spec.Volumes = volumes
+
+	templateTolerations := sets.NewString()
+	for _, toleration := range template.Tolerations {
+		templateTolerations.Insert(toleration.Key)
+	}
+	tolerations := spec.Tolerations[:0]
+	for _, toleration := range spec.Tolerations {
+		if defaultTolerationKeys.Has(toleration.Key) && !templateTolerations.Has(toleration.Key) {
+			continue
+		}
+		tolerations = append(tolerations, toleration)
+	}
+	spec.Tolerations = tolerations
+}
+
+// isConformant returns true if actual equals to expected, except fields in defaultedFields which are not set
+// in expected.
+func isConformant(expected, actual interface{}) bool {
+	switch expectedValue := expected.(type) {
+	case map[string]interface{}:
+		actualValue, ok := actual.(map[string]interface{})
+		if !ok {
+			return isEmpty(expected) && isEmpty(actual)
+		}
+		for key, value := range expectedValue {
+			if !isConformant(value, actualValue[key]) {
+				return false
+			}
+		}
+		for key := range actualValue {
+			if _, ok := expectedValue[key]; !ok && !defaultedFields.Has(key) && !isEmpty(actualValue[key]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		actualValue, ok := actual.([]interface{})
+		if !ok || len(actualValue) != len(expectedValue) {
+			return isEmpty(expected) && isEmpty(actual)
+		}
+		for i := range expectedValue {
+			if !isConformant(expectedValue[i], actualValue[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(expected, actual) || isEmpty(expected) && isEmpty(actual)
+	}
+}
+
+// isEmpty returns true for nil, empty map and empty slice.
+func isEmpty(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
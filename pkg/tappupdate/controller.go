@@ -18,26 +18,38 @@
 package tappupdate
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
 	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
 	clientset "tkestack.io/tapp/pkg/client/clientset/versioned"
+	tappscheme "tkestack.io/tapp/pkg/client/clientset/versioned/scheme"
 	informers "tkestack.io/tapp/pkg/client/informers/externalversions"
 	listers "tkestack.io/tapp/pkg/client/listers/tappcontroller/v1"
 	"tkestack.io/tapp/pkg/util"
 	"tkestack.io/tappupdate/pkg/hash"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 )
 
@@ -45,10 +57,20 @@ const (
 	controllerName              = "tapp-controller-check"
 	oldVersionTemplateHashKey   = "tkestack.io/oldVersion-templateHash-state"
 	oldVersionTemplateHashValue = "not-changed"
+	// dryRunAnnotation is set to "true" on a tapp to only print the plan for it without patching any pod.
+	dryRunAnnotation = "tkestack.io/tapp-update-dry-run"
+	// pausedInstancesAnnotation is a comma separated list of instance ids on a tapp, these instances will be skipped.
+	pausedInstancesAnnotation = "tkestack.io/tapp-update-paused-instances"
+	// skipAnnotation is set to "true" on a tapp to skip it entirely in the job: its pods are not patched or
+	// adopted, its template pool is not collected and its hash scheme is not recorded.
+	skipAnnotation = "tkestack.io/tapp-update-skip"
 )
 
 var (
 	deletePodAfterAppFinish = false
+	dryRun                  = false
+	gcTemplatePool          = true
+	adoptOrphanPods         = false
 )
 
 // Controller is the controller implementation for TApp resources
@@ -66,10 +88,19 @@ type Controller struct {
 	// podStore is a cache of watched pods.
 	podStore corelisters.PodLister
 
+	// podIndexer indexes watched pods by podIndexers.
+	podIndexer cache.Indexer
+
 	// podStoreSynced returns true if the pod store has synced at least once.
 	podStoreSynced cache.InformerSynced
 
+	eventBroadcaster record.EventBroadcaster
+	// recorder is used to record events on tapps whose pods are updated.
+	recorder record.EventRecorder
+
 	updateRetries int
+	// instanceWorkers is the number of instances of a tapp that are processed in parallel.
+	instanceWorkers int
 }
 
 // NewController returns a new tapp controller
@@ -78,24 +109,38 @@ func NewController(
 	tappclientset clientset.Interface,
 	kubeInformerFactory kubeinformers.SharedInformerFactory,
 	tappInformerFactory informers.SharedInformerFactory,
-	updateRetries int) *Controller {
+	updateRetries int,
+	instanceWorkers int) *Controller {
 
 	// obtain references to shared index informers for TApp and pod types.
 	tappInformer := tappInformerFactory.Tappcontroller().V1().TApps()
 	podInformer := kubeInformerFactory.Core().V1().Pods()
 
 	controller := &Controller{
-		kubeclient:    kubeclientset,
-		tappclient:    tappclientset,
-		tappLister:    tappInformer.Lister(),
-		tappsSynced:   tappInformer.Informer().HasSynced,
-		tappHash:      hash.NewTappHash(),
-		updateRetries: updateRetries,
+		kubeclient:      kubeclientset,
+		tappclient:      tappclientset,
+		tappLister:      tappInformer.Lister(),
+		tappsSynced:     tappInformer.Informer().HasSynced,
+		tappHash:        hash.NewTappHash(),
+		updateRetries:   updateRetries,
+		instanceWorkers: instanceWorkers,
 	}
 
 	klog.Info("Setting up event handlers")
 
+	// Events are recorded on tapps, so tapp types must be known by the scheme.
+	utilruntime.Must(tappscheme.AddToScheme(scheme.Scheme))
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
+	controller.eventBroadcaster = eventBroadcaster
+	controller.recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerName})
+
 	controller.podStore = podInformer.Lister()
+	if err := podInformer.Informer().AddIndexers(podIndexers()); err != nil {
+		klog.Errorf("Failed to add pod indexers: %v", err)
+	}
+	controller.podIndexer = podInformer.Informer().GetIndexer()
 
 	controller.podStoreSynced = podInformer.Informer().HasSynced
 
@@ -104,17 +149,32 @@ func NewController(
 
 func (c *Controller) Run(interval int, namesapce, name string, stopCh <-chan struct{}) error {
 	klog.Info("Starting tapp update")
+	// Stop distributing events once tapps are handled. Events already queued are sent by the sink asynchronously,
+	// they may be lost if the process exits right after.
+	defer c.eventBroadcaster.Shutdown()
 	if ok := cache.WaitForCacheSync(stopCh, c.podStoreSynced, c.tappsSynced); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	// Once stopCh is closed, no more tapp or instance is started, in-flight pod operations are finished.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	klog.Info("Starting workers")
+	var errs []error
 	if name != "" {
 		tapp, err := c.tappLister.TApps(namesapce).Get(name)
 		if err != nil {
 			return err
 		}
-		err = c.sync(tapp)
+		err = c.sync(ctx, tapp)
 		if err != nil {
 			return err
 		}
@@ -123,43 +183,59 @@ func (c *Controller) Run(interval int, namesapce, name string, stopCh <-chan str
 		if err != nil {
 			return err
 		}
+		// A failed tapp doesn't stop others from being handled, its error is reported when all tapps are handled.
 		for _, tapp := range tapplist {
-			err = c.sync(tapp)
-			if err != nil {
-				return err
+			if ctx.Err() != nil {
+				break
+			}
+			if !inShard(tapp) {
+				klog.V(4).Infof("Skip tapp %s, it belongs to another shard", util.GetTAppFullName(tapp))
+				continue
+			}
+			if err := c.sync(ctx, tapp); err != nil && ctx.Err() == nil {
+				errs = append(errs, fmt.Errorf("tapp %s: %v", util.GetTAppFullName(tapp), err))
 			}
 		}
 	}
-	return nil
+	logHashStats()
+	if ctx.Err() != nil {
+		return fmt.Errorf("stopped before all tapps are handled")
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// logHashStats prints statistics of hash computations, to find out whether hashing is the bottleneck.
+func logHashStats() {
+	for hashType, s := range hash.GetComputationStats() {
+		klog.Infof("%s hash computations: %d, total duration: %v, average duration: %v, max duration: %v",
+			hashType, s.Count, s.Duration, s.Duration/time.Duration(s.Count), s.MaxDuration)
+	}
 }
 
 // getPodsForTApps returns the pods that match the selectors of the given tapp.
+// The pods are shared with the informer cache, they must not be modified.
 func (c *Controller) getPodsForTApp(tapp *tappv1.TApp) ([]*corev1.Pod, error) {
 	sel, err := metav1.LabelSelectorAsSelector(tapp.Spec.Selector)
 	if err != nil {
 		return []*corev1.Pod{}, err
 	}
-	pods, err := c.podStore.Pods(tapp.Namespace).List(sel)
+	pods, err := podsByIndex(c.podIndexer, podControllerIndex, string(tapp.UID))
 	if err != nil {
 		return []*corev1.Pod{}, err
 	}
 	result := make([]*corev1.Pod, 0, len(pods))
 	for i := range pods {
-		controllerRef := metav1.GetControllerOf(pods[i])
-		if controllerRef == nil {
-			continue
-		}
-		if controllerRef.UID == tapp.UID {
-			result = append(result, pods[i].DeepCopy())
-		} else {
-			klog.V(4).Infof("pod %s in namespace %s matches the selector of tapp %s, but has different controllerRef",
+		if pods[i].Namespace != tapp.Namespace || !sel.Matches(labels.Set(pods[i].Labels)) {
+			klog.V(4).Infof("pod %s in namespace %s is controlled by tapp %s, but does not match its selector",
 				pods[i].Name, pods[i].Namespace, util.GetTAppFullName(tapp))
+			continue
 		}
+		result = append(result, pods[i])
 	}
 	return result, nil
 }
 
-func (c *Controller) sync(tapp *tappv1.TApp) error {
+func (c *Controller) sync(ctx context.Context, tapp *tappv1.TApp) error {
 	pods, err := c.getPodsForTApp(tapp)
 	if err != nil {
 		klog.Errorf("Failed to get pods for tapp %s: %v", util.GetTAppFullName(tapp), err)
@@ -171,51 +247,139 @@ func (c *Controller) sync(tapp *tappv1.TApp) error {
 			tapp.Spec.Replicas, tapp.Status.AppStatus)
 		return nil
 	}
-	c.syncTApp(tapp, pods)
-	return nil
+	computations := hash.GetComputationCount()
+	err = c.syncTApp(ctx, tapp, pods)
+	klog.V(4).Infof("Hash computations for tapp %s: %d", util.GetTAppFullName(tapp),
+		hash.GetComputationCount()-computations)
+	return err
 }
 
-func (c *Controller) syncTApp(tapp *tappv1.TApp, pods []*corev1.Pod) error {
-	tapp = tapp.DeepCopy()
+func (c *Controller) syncTApp(ctx context.Context, tapp *tappv1.TApp, pods []*corev1.Pod) error {
+	if tapp.Annotations[skipAnnotation] == "true" {
+		klog.V(2).Infof("Skip tapp %s, it has annotation %s", util.GetTAppFullName(tapp), skipAnnotation)
+		return nil
+	}
+	if err := checkHashScheme(tapp); err != nil {
+		klog.Errorf("Refuse to sync tapp %s: %v", util.GetTAppFullName(tapp), err)
+		c.recorder.Eventf(tapp, corev1.EventTypeWarning, hashSchemeEventReason(err), "Refuse to sync: %v", err)
+		return err
+	}
+	tapp = copyTAppTemplates(tapp)
 	c.updateTemplateHash(tapp)
+	if getAdoptOrphanPods() {
+		pods = append(pods, c.adoptOrphanPods(tapp)...)
+	}
 	podMap := makePodMap(pods)
 
 	desiredRunningPods := getDesiredInstance(tapp)
-	c.syncRunningPods(tapp, desiredRunningPods, podMap)
+	// Only instances whose template is missing are skipped, others are still handled.
+	if invalid, err := validateTemplateReferences(&tapp.Spec, desiredRunningPods); err != nil {
+		klog.Errorf("Invalid templates of tapp %s, skip instances %v: %v", util.GetTAppFullName(tapp),
+			invalid.List(), err)
+		c.recorder.Eventf(tapp, corev1.EventTypeWarning, "InvalidTemplates", "Skip instances %s: %v",
+			formatInstanceIds(invalid.List()), err)
+		desiredRunningPods = desiredRunningPods.Difference(invalid)
+	}
+	if err := c.syncRunningPods(ctx, tapp, desiredRunningPods, podMap); err != nil {
+		klog.Errorf("Failed to sync running pods of tapp %s: %v", util.GetTAppFullName(tapp), err)
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if getGCTemplatePool() {
+		if err := c.gcTemplatePool(tapp); err != nil {
+			klog.Errorf("Failed to delete unused templates for tapp %s: %v", util.GetTAppFullName(tapp), err)
+			return err
+		}
+	}
+
+	if !isDryRun(tapp) {
+		if err := c.recordHashScheme(tapp); err != nil {
+			klog.Errorf("Failed to record hash scheme for tapp %s: %v", util.GetTAppFullName(tapp), err)
+			return err
+		}
+	}
 	return nil
 }
 
 // updateTemplateHash will generate and update templates hash if needed.
 func (c *Controller) updateTemplateHash(tapp *tappv1.TApp) {
 	updateHash := func(template *corev1.PodTemplateSpec) {
-		if c.tappHash.SetTemplateHash(template) {
-			if c.tappHash.SetUniqHash(template) {
-				c.tappHash.SetSpecHash(template)
-			}
-		}
+		hash.UpdateHashes(c.tappHash, template)
 	}
 
 	updateHash(&tapp.Spec.Template)
 
-	for _, template := range tapp.Spec.TemplatePool {
+	for name, template := range tapp.Spec.TemplatePool {
 		updateHash(&template)
+		tapp.Spec.TemplatePool[name] = template
 	}
 }
 
-func (c *Controller) syncRunningPods(tapp *tappv1.TApp, desiredRunningPods sets.String,
-	podMap map[string]*corev1.Pod) {
+func (c *Controller) syncRunningPods(ctx context.Context, tapp *tappv1.TApp, desiredRunningPods sets.String,
+	podMap map[string]*corev1.Pod) error {
+	plan := c.planRunningPods(tapp, desiredRunningPods, podMap)
+	if isDryRun(tapp) {
+		logPlan(tapp, plan)
+		return nil
+	}
+	var ids []string
 	for _, id := range desiredRunningPods.List() {
-		if pod, ok := podMap[id]; ok {
-			if !c.isTemplateHashChanged(tapp, id, pod) {
-				_, found := pod.Labels[hash.SpecHashKey]
-				if found {
-					continue
-				}
-				c.setSpecHash(tapp, id, pod)
+		if plan[id] == actionSetSpecHash {
+			ids = append(ids, id)
+		}
+	}
+	patched := make([]bool, len(ids))
+	errs := make([]error, len(ids))
+	// Instances are independent from each other, so patch them in parallel.
+	workqueue.ParallelizeUntil(ctx, c.instanceWorkers, len(ids), func(i int) {
+		patched[i], errs[i] = c.setSpecHash(tapp, ids[i], podMap[ids[i]])
+	})
+
+	var updated []string
+	for i := range ids {
+		if patched[i] {
+			updated = append(updated, ids[i])
+		}
+	}
+	// Labels projected by downward API volumes will be refreshed by kubelet, let the app know which changed.
+	c.recordInstancesEvent(tapp, corev1.EventTypeNormal, "MetaUpdated", "Updated pod labels "+hash.SpecHashKey,
+		updated)
+	c.recordInstancesErrors(tapp, "MetaUpdateFailed", "Failed to update pod labels "+hash.SpecHashKey, ids, errs)
+	return utilerrors.NewAggregate(errs)
+}
+
+// planRunningPods returns the action for each desired running instance which has a pod.
+func (c *Controller) planRunningPods(tapp *tappv1.TApp, desiredRunningPods sets.String,
+	podMap map[string]*corev1.Pod) map[string]instanceAction {
+	plan := make(map[string]instanceAction, len(podMap))
+	paused := getPausedInstances(tapp)
+	for _, id := range desiredRunningPods.List() {
+		pod, ok := podMap[id]
+		if !ok {
+			continue
+		}
+		if paused.Has(id) {
+			plan[id] = actionPaused
+			continue
+		}
+		if c.isTemplateHashChanged(tapp, id, pod) {
+			if c.isUniqHashChanged(tapp, id, pod) {
+				plan[id] = actionRecreate
+			} else {
+				plan[id] = actionInPlaceUpdate
 			}
+			continue
+		}
+		if _, found := pod.Labels[hash.SpecHashKey]; found {
+			plan[id] = actionNone
+		} else {
+			plan[id] = actionSetSpecHash
 		}
 	}
-	return
+	return plan
 }
 
 func (c *Controller) isTemplateHashChanged(tapp *tappv1.TApp, podId string, pod *corev1.Pod) bool {
@@ -243,38 +407,116 @@ func (c *Controller) isUniqHashChanged(tapp *tappv1.TApp, podId string, pod *cor
 	return hash != expected
 }
 
-func (c *Controller) setSpecHash(tapp *tappv1.TApp, podId string, pod *corev1.Pod) {
+// setSpecHash patches spec hash label into pod with a JSON patch, whose test operations make sure pod is not
+// modified since we checked it and its template hash is still expected. If the test fails, it is retried with
+// latest pod. It returns true if pod is patched.
+func (c *Controller) setSpecHash(tapp *tappv1.TApp, podId string, pod *corev1.Pod) (bool, error) {
 	template, err := getPodTemplate(&tapp.Spec, podId)
 	if err != nil {
 		klog.Errorf("Failed to get pod template for %s from tapp %s", getPodFullName(pod),
 			util.GetTAppFullName(tapp))
-		return
+		return false, err
 	}
 	specHash := c.tappHash.GetSpecHash(template.Labels)
+	templateHash := c.tappHash.GetTemplateHash(template.Labels)
+
+	backoff := retry.DefaultBackoff
+	backoff.Steps = c.updateRetries + 1
+	// The first try uses pod from cache, retries get latest pod from apiserver.
+	cp := pod
+	patched := false
+	var lastErr error
+	err = wait.ExponentialBackoff(backoff, func() (bool, error) {
+		if cp == nil {
+			latest, err := c.kubeclient.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			cp = latest
+		}
+		current := cp
+		cp = nil
+		if current.UID != pod.UID || c.tappHash.GetTemplateHash(current.Labels) != templateHash {
+			klog.V(3).Infof("pod %s has changed, skip setting spec hash", getPodFullName(pod))
+			return true, nil
+		}
+		if _, found := current.Labels[hash.SpecHashKey]; found {
+			return true, nil
+		}
+		playLoadBytes := specHashPatch(current.UID, templateHash, specHash)
+		klog.V(3).Infof("set spec hash for pod %s", getPodFullName(current))
+
+		_, err := c.kubeclient.CoreV1().Pods(current.Namespace).Patch(current.Name, types.JSONPatchType, playLoadBytes)
+		switch {
+		case err == nil:
+			patched = true
+			return true, nil
+		case errors.IsInvalid(err) || errors.IsConflict(err):
+			// Test operations failed, pod is modified by others, retry with latest pod.
+			klog.V(3).Infof("pod %s is modified, will retry: %v", getPodFullName(current), err)
+			lastErr = err
+			return false, nil
+		default:
+			klog.Errorf("Failed to patch pod %s: %v", getPodFullName(current), err)
+			return false, err
+		}
+	})
+	if err == wait.ErrWaitTimeout && lastErr != nil {
+		err = lastErr
+	}
+	if err != nil {
+		klog.Errorf("Failed to set spec hash for pod %s: %v", getPodFullName(pod), err)
+		return false, err
+	}
+	return patched, nil
+}
+
+// specHashPatch returns a JSON patch which sets specHash into pod's labels if pod is still the pod with uid and its
+// template hash is not changed. Writes to other fields, e.g. pod status by kubelet, don't fail the patch. It only
+// touches labels, so other fields like ephemeral containers are kept.
+func specHashPatch(uid types.UID, templateHash, specHash string) []byte {
+	patchData := []map[string]string{
+		{"op": "test", "path": "/metadata/uid", "value": string(uid)},
+		{"op": "test", "path": labelPath(hash.TemplateHashKey), "value": templateHash},
+		{"op": "add", "path": labelPath(hash.SpecHashKey), "value": specHash},
+	}
+	playLoadBytes, _ := json.Marshal(patchData)
+	return playLoadBytes
+}
 
-	var cp *corev1.Pod
+// patchTApp gets latest tapp from apiserver and sends the JSON merge patch returned by makePatch for it, if
+// makePatch returns a non-nil patch. The patch is guarded by resourceVersion of latest tapp, so it is only applied
+// if tapp is not modified since makePatch checked it, otherwise it is retried with latest tapp.
+func (c *Controller) patchTApp(tapp *tappv1.TApp,
+	makePatch func(latest *tappv1.TApp) (map[string]interface{}, error)) error {
+	var err error
 	for i := 0; i <= c.updateRetries; i++ {
-		if cp, err = c.podStore.Pods(pod.Namespace).Get(pod.Name); err != nil {
-			klog.Errorf("Failed to get pod %s, will retry: %v", getPodFullName(pod), err)
-			break
+		var latest *tappv1.TApp
+		latest, err = c.tappclient.TappcontrollerV1().TApps(tapp.Namespace).Get(tapp.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("Failed to get tapp %s, will retry: %v", util.GetTAppFullName(tapp), err)
+			continue
 		}
-		_, found := pod.Labels[hash.SpecHashKey]
-		if found {
-			break
+		var patch map[string]interface{}
+		if patch, err = makePatch(latest); err != nil || patch == nil {
+			return err
+		}
+		metadata, _ := patch["metadata"].(map[string]interface{})
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+			patch["metadata"] = metadata
 		}
-		podCopy := cp.DeepCopy()
-		podCopy.Labels[hash.SpecHashKey] = specHash
-		patchData := map[string]interface{}{"metadata": map[string]map[string]string{"labels": podCopy.Labels}}
-		playLoadBytes, _ := json.Marshal(patchData)
-		klog.V(3).Infof("set spec hash for pod %s/%s", podCopy.Namespace, podCopy.Name)
+		metadata["resourceVersion"] = latest.ResourceVersion
+		playLoadBytes, _ := json.Marshal(patch)
 
-		_, err = c.kubeclient.CoreV1().Pods(podCopy.Namespace).Patch(podCopy.Name, types.StrategicMergePatchType, playLoadBytes)
+		_, err = c.tappclient.TappcontrollerV1().TApps(latest.Namespace).Patch(latest.Name, types.MergePatchType,
+			playLoadBytes)
 		if err == nil {
-			break
+			return nil
 		}
-		klog.Errorf("Failed to patch pod %s, will retry: %v", getPodFullName(podCopy), err)
+		klog.Errorf("Failed to patch tapp %s, will retry: %v", util.GetTAppFullName(tapp), err)
 	}
-
+	return err
 }
 
 func getDesiredInstance(tapp *tappv1.TApp) (running sets.String) {
@@ -325,3 +567,30 @@ func SetDeletePodAfterAppFinish(value bool) {
 func getDeletePodAfterAppFinish() bool {
 	return deletePodAfterAppFinish
 }
+
+// SetDryRun makes the controller only print its plan for all tapps, without patching any pod.
+func SetDryRun(value bool) {
+	dryRun = value
+}
+
+func getDryRun() bool {
+	return dryRun
+}
+
+// SetGCTemplatePool sets whether to delete templatePool entries which are not used by any instance or pod.
+func SetGCTemplatePool(value bool) {
+	gcTemplatePool = value
+}
+
+func getGCTemplatePool() bool {
+	return gcTemplatePool
+}
+
+// SetAdoptOrphanPods sets whether to adopt pods which match tapp's selector but have no controller.
+func SetAdoptOrphanPods(value bool) {
+	adoptOrphanPods = value
+}
+
+func getAdoptOrphanPods() bool {
+	return adoptOrphanPods
+}
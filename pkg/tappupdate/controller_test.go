@@ -0,0 +1,330 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	v1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	tappfake "tkestack.io/tapp/pkg/client/clientset/versioned/fake"
+	"tkestack.io/tappupdate/pkg/hash"
+	pkgtesting "tkestack.io/tappupdate/pkg/testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const benchmarkInstances = 1000
+
+// newTestController returns a controller with fake clients and a fake recorder, pods are added into both pod cache
+// and fake kubeclient, tapps are added into fake tappclient.
+func newTestController(pods []*corev1.Pod, tapps ...*v1.TApp) (*Controller, *fake.Clientset, *tappfake.Clientset) {
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, podIndexers())
+	podObjects := make([]runtime.Object, 0, len(pods))
+	for _, pod := range pods {
+		podIndexer.Add(pod)
+		podObjects = append(podObjects, pod)
+	}
+	tappObjects := make([]runtime.Object, 0, len(tapps))
+	for _, tapp := range tapps {
+		tappObjects = append(tappObjects, tapp)
+	}
+	kubeclient := fake.NewSimpleClientset(podObjects...)
+	tappclient := tappfake.NewSimpleClientset(tappObjects...)
+	c := &Controller{
+		kubeclient:      kubeclient,
+		tappclient:      tappclient,
+		tappHash:        hash.NewTappHash(),
+		podStore:        corelisters.NewPodLister(podIndexer),
+		podIndexer:      podIndexer,
+		recorder:        record.NewFakeRecorder(100),
+		updateRetries:   1,
+		instanceWorkers: 1,
+	}
+	return c, kubeclient, tappclient
+}
+
+// getWriteActions returns actions which modify objects.
+func getWriteActions(actions ...[]core.Action) []core.Action {
+	var writes []core.Action
+	for _, list := range actions {
+		for _, action := range list {
+			switch action.GetVerb() {
+			case "create", "update", "patch", "delete":
+				writes = append(writes, action)
+			}
+		}
+	}
+	return writes
+}
+
+func TestSpecHashPatchKeepsEphemeralContainers(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-0",
+			UID:  "uid",
+			// Pod is updated by kubelet after it is listed, which doesn't fail the patch.
+			ResourceVersion: "11",
+			Labels:          map[string]string{hash.TemplateHashKey: "template"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "main", Image: "main:v1"}},
+			EphemeralContainers: []corev1.EphemeralContainer{{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox"},
+				TargetContainerName:      "main",
+			}},
+		},
+	}
+	podJSON, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("Failed to marshal pod: %v", err)
+	}
+
+	patch, err := jsonpatch.DecodePatch(specHashPatch("uid", "template", "spec"))
+	if err != nil {
+		t.Fatalf("Failed to decode patch: %v", err)
+	}
+	patchedJSON, err := patch.Apply(podJSON)
+	if err != nil {
+		t.Fatalf("Failed to apply patch: %v", err)
+	}
+	patched := &corev1.Pod{}
+	if err := json.Unmarshal(patchedJSON, patched); err != nil {
+		t.Fatalf("Failed to unmarshal patched pod: %v", err)
+	}
+	if patched.Labels[hash.SpecHashKey] != "spec" {
+		t.Errorf("Spec hash is not set, labels: %v", patched.Labels)
+	}
+	if !reflect.DeepEqual(patched.Spec, pod.Spec) {
+		t.Errorf("Pod spec is modified, expected %v, got %v", pod.Spec, patched.Spec)
+	}
+
+	// Test operations fail if pod is recreated or its template hash is changed.
+	for _, data := range [][]byte{specHashPatch("other", "template", "spec"), specHashPatch("uid", "other", "spec")} {
+		patch, err := jsonpatch.DecodePatch(data)
+		if err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+		if _, err := patch.Apply(podJSON); err == nil {
+			t.Errorf("Expected patch %s to fail", data)
+		}
+	}
+}
+
+// countActions returns the number of actions on pods with verb.
+func countActions(actions []core.Action, verb string) int {
+	count := 0
+	for _, action := range actions {
+		if action.GetVerb() == verb && action.GetResource().Resource == "pods" {
+			count++
+		}
+	}
+	return count
+}
+
+// newSpecHashTest returns a tapp and its pod of instance 0 without spec hash label, and a controller with the pod.
+func newSpecHashTest(t *testing.T) (*Controller, *fake.Clientset, *v1.TApp, *corev1.Pod) {
+	tapp := createBenchmarkTApp(1)
+	pod := mustNewPod(t, tapp, "0")
+	delete(pod.Labels, hash.SpecHashKey)
+	c, kubeclient, _ := newTestController([]*corev1.Pod{pod}, tapp)
+	return c, kubeclient, tapp, pod
+}
+
+func TestSetSpecHashRetry(t *testing.T) {
+	for _, patchErr := range []error{
+		apierrors.NewInvalid(schema.GroupKind{Kind: "Pod"}, "test-0", field.ErrorList{}),
+		apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, "test-0", errors.New("modified")),
+	} {
+		c, kubeclient, tapp, pod := newSpecHashTest(t)
+		failed := false
+		kubeclient.PrependReactor("patch", "pods", func(action core.Action) (bool, runtime.Object, error) {
+			if failed {
+				return false, nil, nil
+			}
+			failed = true
+			return true, nil, patchErr
+		})
+
+		patched, err := c.setSpecHash(tapp, "0", pod)
+		if err != nil || !patched {
+			t.Fatalf("Expected pod to be patched after %v, got %t, %v", patchErr, patched, err)
+		}
+		// The retry gets the latest pod from apiserver instead of using the cached one again.
+		actions := kubeclient.Actions()
+		if gets, patches := countActions(actions, "get"), countActions(actions, "patch"); gets != 1 || patches != 2 {
+			t.Errorf("Expected 1 get and 2 patches after %v, got %d gets and %d patches", patchErr, gets, patches)
+		}
+		latest, err := kubeclient.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get pod: %v", err)
+		}
+		if _, found := latest.Labels[hash.SpecHashKey]; !found {
+			t.Errorf("Expected label %s to be set after %v", hash.SpecHashKey, patchErr)
+		}
+	}
+}
+
+func TestSetSpecHashPodChanged(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(pod *corev1.Pod)
+	}{
+		{name: "recreated", mutate: func(pod *corev1.Pod) { pod.UID = "recreated" }},
+		{name: "template changed", mutate: func(pod *corev1.Pod) { pod.Labels[hash.TemplateHashKey] = "changed" }},
+	}
+	for _, test := range tests {
+		c, kubeclient, tapp, pod := newSpecHashTest(t)
+		kubeclient.PrependReactor("patch", "pods", func(action core.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewInvalid(schema.GroupKind{Kind: "Pod"}, pod.Name, field.ErrorList{})
+		})
+		kubeclient.PrependReactor("get", "pods", func(action core.Action) (bool, runtime.Object, error) {
+			latest := pod.DeepCopy()
+			test.mutate(latest)
+			return true, latest, nil
+		})
+
+		patched, err := c.setSpecHash(tapp, "0", pod)
+		if err != nil || patched {
+			t.Errorf("%s: expected pod to be skipped, got %t, %v", test.name, patched, err)
+		}
+		if patches := countActions(kubeclient.Actions(), "patch"); patches != 1 {
+			t.Errorf("%s: expected no patch after pod changed, got %d patches", test.name, patches)
+		}
+	}
+}
+
+func TestSetSpecHashRetriesExhausted(t *testing.T) {
+	c, kubeclient, tapp, pod := newSpecHashTest(t)
+	kubeclient.PrependReactor("patch", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, pod.Name, errors.New("modified"))
+	})
+
+	patched, err := c.setSpecHash(tapp, "0", pod)
+	if patched {
+		t.Errorf("Expected pod not to be patched")
+	}
+	// The error of the last try is returned instead of a timeout.
+	if !apierrors.IsConflict(err) {
+		t.Errorf("Expected conflict error, got %v", err)
+	}
+	if patches := countActions(kubeclient.Actions(), "patch"); patches != c.updateRetries+1 {
+		t.Errorf("Expected %d patches, got %d", c.updateRetries+1, patches)
+	}
+}
+
+func TestSyncTAppPatchPodFailed(t *testing.T) {
+	tapp := createBenchmarkTApp(2)
+	var pods []*corev1.Pod
+	for i := 0; i < 2; i++ {
+		pod := mustNewPod(t, tapp, strconv.Itoa(i))
+		delete(pod.Labels, hash.SpecHashKey)
+		pods = append(pods, pod)
+	}
+	c, kubeclient, tappclient := newTestController(pods, tapp)
+	kubeclient.PrependReactor("patch", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("patch failed")
+	})
+
+	if err := c.syncTApp(context.Background(), tapp, pods); err == nil {
+		t.Errorf("Expected error for failed patches of pods")
+	}
+	// Hash scheme is not recorded, so the tapp is handled again in next run.
+	if writes := getWriteActions(tappclient.Actions()); len(writes) != 0 {
+		t.Errorf("Expected no write to tapp, got %v", writes)
+	}
+}
+
+func TestSyncTAppSkip(t *testing.T) {
+	// Without the annotation the same tapp is synced, which makes sure the fake clients see writes at all.
+	for _, skip := range []bool{false, true} {
+		tapp := createBenchmarkTApp(2)
+		if skip {
+			tapp.Annotations = map[string]string{skipAnnotation: "true"}
+		}
+		var pods []*corev1.Pod
+		for i := 0; i < 2; i++ {
+			pod := mustNewPod(t, tapp, strconv.Itoa(i))
+			delete(pod.Labels, hash.SpecHashKey)
+			pods = append(pods, pod)
+		}
+		c, kubeclient, tappclient := newTestController(pods, tapp)
+
+		if err := c.syncTApp(context.Background(), tapp, pods); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		writes := getWriteActions(kubeclient.Actions(), tappclient.Actions())
+		if skip && len(writes) != 0 {
+			t.Errorf("Expected no write for tapp with annotation %s, got %v", skipAnnotation, writes)
+		}
+		if !skip && len(writes) == 0 {
+			t.Errorf("Expected pods to be patched for tapp without annotation %s", skipAnnotation)
+		}
+		if events := c.recorder.(*record.FakeRecorder).Events; skip && len(events) != 0 {
+			t.Errorf("Expected no event for tapp with annotation %s, got %d", skipAnnotation, len(events))
+		}
+	}
+}
+
+func BenchmarkCopyTAppTemplates(b *testing.B) {
+	tapp := createBenchmarkTApp(benchmarkInstances)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copyTAppTemplates(tapp)
+	}
+}
+
+func BenchmarkPlanRunningPods(b *testing.B) {
+	c := &Controller{tappHash: hash.NewTappHash()}
+	tapp := createBenchmarkTApp(benchmarkInstances)
+	pods, err := pkgtesting.NewPods(tapp)
+	if err != nil {
+		b.Fatalf("Failed to create pods: %v", err)
+	}
+	podMap := makePodMap(pods)
+	desiredRunningPods := getDesiredInstance(tapp)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.planRunningPods(tapp, desiredRunningPods, podMap)
+	}
+}
+
+func createBenchmarkTApp(replicas int) *v1.TApp {
+	tapp := pkgtesting.NewTApp("default", "test", replicas, createTemplate("default"))
+	var ids []string
+	for i := 0; i < replicas; i += 2 {
+		ids = append(ids, strconv.Itoa(i))
+	}
+	pkgtesting.AddTemplate(tapp, "pool", createTemplate("pool"), ids...)
+	return tapp
+}
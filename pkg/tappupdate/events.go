@@ -0,0 +1,89 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordInstancesEvent records one event on tapp for all instances, instead of one event for each pod,
+// to avoid flooding apiserver with events when a tapp has lots of instances.
+func (c *Controller) recordInstancesEvent(tapp *tappv1.TApp, eventType, reason, message string, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	c.recorder.Eventf(tapp, eventType, reason, "%s: %d instances %s", message, len(ids), formatInstanceIds(ids))
+}
+
+// recordInstancesErrors records one warning event on tapp for each reason of errs, errs[i] is the error of
+// instance ids[i]. Repeated failures with the same reason are deduplicated into a single event.
+func (c *Controller) recordInstancesErrors(tapp *tappv1.TApp, reason, message string, ids []string, errs []error) {
+	failed := make(map[metav1.StatusReason][]string)
+	samples := make(map[metav1.StatusReason]error)
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		errReason := errors.ReasonForError(err)
+		failed[errReason] = append(failed[errReason], ids[i])
+		if _, ok := samples[errReason]; !ok {
+			samples[errReason] = err
+		}
+	}
+	for errReason, failedIds := range failed {
+		c.recorder.Eventf(tapp, corev1.EventTypeWarning, reason, "%s: %d instances %s, e.g. %v", message,
+			len(failedIds), formatInstanceIds(failedIds), samples[errReason])
+	}
+}
+
+// formatInstanceIds returns ids sorted in numerical order, consecutive ids are merged into a range,
+// e.g. "[0-2,5]".
+func formatInstanceIds(ids []string) string {
+	sorted := make([]string, len(ids))
+	copy(sorted, ids)
+	sortInstanceIds(sorted)
+
+	var ranges []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && isNextInstanceId(sorted[j], sorted[j+1]) {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, sorted[i])
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%s-%s", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return "[" + strings.Join(ranges, ",") + "]"
+}
+
+func isNextInstanceId(id, next string) bool {
+	a, errA := strconv.Atoi(id)
+	b, errB := strconv.Atoi(next)
+	return errA == nil && errB == nil && a+1 == b
+}
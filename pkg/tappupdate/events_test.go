@@ -0,0 +1,84 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestFormatInstanceIds(t *testing.T) {
+	tests := []struct {
+		ids      []string
+		expected string
+	}{
+		{ids: nil, expected: "[]"},
+		{ids: []string{"3"}, expected: "[3]"},
+		{ids: []string{"2", "0", "1", "5", "10", "7", "6"}, expected: "[0-2,5-7,10]"},
+	}
+	for _, test := range tests {
+		if got := formatInstanceIds(test.ids); got != test.expected {
+			t.Errorf("Failed to format instance ids %v, expected %s, got %s", test.ids, test.expected, got)
+		}
+	}
+}
+
+func TestRecordInstancesErrors(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{recorder: recorder}
+	tapp := &v1.TApp{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}}
+	pods := schema.GroupResource{Resource: "pods"}
+	ids := []string{"0", "1", "2", "3", "4"}
+	errs := []error{
+		errors.NewConflict(pods, "test-0", fmt.Errorf("modified")),
+		nil,
+		errors.NewConflict(pods, "test-2", fmt.Errorf("modified")),
+		errors.NewNotFound(pods, "test-3"),
+		errors.NewConflict(pods, "test-4", fmt.Errorf("modified")),
+	}
+	c.recordInstancesErrors(tapp, "MetaUpdateFailed", "Failed to update pod labels", ids, errs)
+
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	// One event for each reason of errors.
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %v", len(events), events)
+	}
+	sort.Strings(events)
+	expected := []string{
+		"Warning MetaUpdateFailed Failed to update pod labels: 1 instances [3]",
+		"Warning MetaUpdateFailed Failed to update pod labels: 3 instances [0,2,4]",
+	}
+	for i, event := range events {
+		if !strings.HasPrefix(event, expected[i]) {
+			t.Errorf("Expected event %q to start with %q", event, expected[i])
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"tkestack.io/tappupdate/pkg/hash"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// podControllerIndex indexes pods by UID of the tapp controlling them.
+	podControllerIndex = "tappController"
+	// podInstanceIndex indexes pods by UID of the tapp controlling them and their instance id.
+	podInstanceIndex = "tappInstance"
+	// podTemplateHashIndex indexes pods by namespace and their template hash.
+	podTemplateHashIndex = "tappTemplateHash"
+)
+
+// podIndexers returns indexers which are added to pod informer.
+func podIndexers() cache.Indexers {
+	return cache.Indexers{
+		podControllerIndex:   indexPodByController,
+		podInstanceIndex:     indexPodByInstance,
+		podTemplateHashIndex: indexPodByTemplateHash,
+	}
+}
+
+func indexPodByController(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	controllerRef := metav1.GetControllerOf(pod)
+	if controllerRef == nil || controllerRef.Kind != "TApp" {
+		return nil, nil
+	}
+	return []string{string(controllerRef.UID)}, nil
+}
+
+func indexPodByInstance(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	controllerRef := metav1.GetControllerOf(pod)
+	if controllerRef == nil || controllerRef.Kind != "TApp" {
+		return nil, nil
+	}
+	id, err := getPodIndex(pod)
+	if err != nil {
+		return nil, nil
+	}
+	return []string{instanceIndexKey(controllerRef.UID, id)}, nil
+}
+
+func indexPodByTemplateHash(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	templateHash, ok := pod.Labels[hash.TemplateHashKey]
+	if !ok {
+		return nil, nil
+	}
+	return []string{templateHashIndexKey(pod.Namespace, templateHash)}, nil
+}
+
+func instanceIndexKey(uid types.UID, id string) string {
+	return string(uid) + "/" + id
+}
+
+func templateHashIndexKey(namespace, templateHash string) string {
+	return namespace + "/" + templateHash
+}
+
+// podsByIndex returns pods in indexer whose indexed value for indexName is key.
+func podsByIndex(indexer cache.Indexer, indexName, key string) ([]*corev1.Pod, error) {
+	objs, err := indexer.ByIndex(indexName, key)
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]*corev1.Pod, 0, len(objs))
+	for _, obj := range objs {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
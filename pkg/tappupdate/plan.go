@@ -0,0 +1,62 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"strings"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tapp/pkg/util"
+
+	"k8s.io/klog"
+)
+
+// instanceAction is the action that will be taken for a running instance.
+type instanceAction string
+
+const (
+	// actionNone means pod is up to date and already has spec hash.
+	actionNone instanceAction = "None"
+	// actionSetSpecHash means pod is up to date, but spec hash needs to be set into its labels.
+	actionSetSpecHash instanceAction = "SetSpecHash"
+	// actionInPlaceUpdate means only container images changed, tapp controller will do in-place update for pod.
+	actionInPlaceUpdate instanceAction = "InPlaceUpdate"
+	// actionRecreate means pod template changed, tapp controller will recreate pod.
+	actionRecreate instanceAction = "Recreate"
+	// actionPaused means instance is paused, we will not touch its pod.
+	actionPaused instanceAction = "Paused"
+)
+
+// isDryRun returns true if we should only print the plan for tapp.
+func isDryRun(tapp *tappv1.TApp) bool {
+	return getDryRun() || tapp.Annotations[dryRunAnnotation] == "true"
+}
+
+// logPlan prints instances of tapp grouped by their planned action.
+func logPlan(tapp *tappv1.TApp, plan map[string]instanceAction) {
+	ids := make(map[instanceAction][]string)
+	for id, action := range plan {
+		ids[action] = append(ids[action], id)
+	}
+	for _, action := range []instanceAction{actionRecreate, actionInPlaceUpdate, actionSetSpecHash, actionNone,
+		actionPaused} {
+		sortInstanceIds(ids[action])
+		klog.Infof("[dry-run] tapp %s, action %s: %d instances [%s]", util.GetTAppFullName(tapp), action,
+			len(ids[action]), strings.Join(ids[action], ","))
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tappupdate
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tappupdate/pkg/hash"
+	pkgtesting "tkestack.io/tappupdate/pkg/testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPlanRunningPods(t *testing.T) {
+	tapp := pkgtesting.NewTApp("default", "test", 6, createTemplate("v1"))
+	tapp.Annotations = map[string]string{pausedInstancesAnnotation: "4"}
+
+	// Pods created from an older template with another image.
+	imageChanged := pkgtesting.NewTApp("default", "test", 6,
+		pkgtesting.NewTemplate(map[string]string{"template": "v1"}, "v0"))
+	// Pods created from an older template with other args.
+	argsChanged := createTemplate("v1")
+	argsChanged.Spec.Containers[0].Args = []string{"--old"}
+	specChanged := pkgtesting.NewTApp("default", "test", 6, argsChanged)
+
+	withoutSpecHash := mustNewPod(t, tapp, "1")
+	delete(withoutSpecHash.Labels, hash.SpecHashKey)
+	pods := []*corev1.Pod{
+		mustNewPod(t, tapp, "0"),
+		withoutSpecHash,
+		mustNewPod(t, imageChanged, "2"),
+		mustNewPod(t, specChanged, "3"),
+		mustNewPod(t, specChanged, "4"),
+		// Instance 5 has no pod.
+	}
+
+	c := &Controller{tappHash: hash.NewTappHash()}
+	plan := c.planRunningPods(tapp, getDesiredInstance(tapp), makePodMap(pods))
+	expected := map[string]instanceAction{
+		"0": actionNone,
+		"1": actionSetSpecHash,
+		"2": actionInPlaceUpdate,
+		"3": actionRecreate,
+		"4": actionPaused,
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("Expected plan %v, got %v", expected, plan)
+	}
+}
+
+func TestSyncTAppDryRun(t *testing.T) {
+	defer SetDryRun(false)
+	defer SetAdoptOrphanPods(false)
+	SetAdoptOrphanPods(true)
+
+	// Without dry run the same tapp is synced, which makes sure the fake clients see writes at all.
+	for _, mode := range []string{"none", "flag", "annotation"} {
+		SetDryRun(mode == "flag")
+		tapp := pkgtesting.NewTApp("default", "test", 2, createTemplate("v1"))
+		if mode == "annotation" {
+			tapp.Annotations = map[string]string{dryRunAnnotation: "true"}
+		}
+		// Unused template is deleted without dry run.
+		pkgtesting.AddTemplate(tapp, "unused", createTemplate("unused"))
+
+		pod := mustNewPod(t, tapp, "0")
+		delete(pod.Labels, hash.SpecHashKey)
+		// Orphan pod is adopted without dry run.
+		orphan := mustNewPod(t, tapp, "1")
+		orphan.OwnerReferences = nil
+		c, kubeclient, tappclient := newTestController([]*corev1.Pod{pod, orphan}, tapp)
+
+		if err := c.syncTApp(context.Background(), tapp, []*corev1.Pod{pod}); err != nil {
+			t.Errorf("%s: unexpected error: %v", mode, err)
+		}
+		writes := getWriteActions(kubeclient.Actions(), tappclient.Actions())
+		if mode == "none" && len(writes) == 0 {
+			t.Errorf("Expected pods and tapp to be written without dry run")
+		}
+		if mode != "none" && len(writes) != 0 {
+			t.Errorf("%s: expected no write in dry run mode, got %v", mode, writes)
+		}
+	}
+}
+
+func TestIsDryRun(t *testing.T) {
+	defer SetDryRun(false)
+	tapp := &v1.TApp{}
+	if isDryRun(tapp) {
+		t.Errorf("Expected no dry run by default")
+	}
+	tapp.Annotations = map[string]string{dryRunAnnotation: "true"}
+	if !isDryRun(tapp) {
+		t.Errorf("Expected dry run with annotation %s", dryRunAnnotation)
+	}
+	tapp.Annotations = nil
+	SetDryRun(true)
+	if !isDryRun(tapp) {
+		t.Errorf("Expected dry run with flag")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tappupdate
+
+import (
+	"fmt"
+	"strings"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// requiredPermission is a set of verbs the controller needs on a resource.
+type requiredPermission struct {
+	group       string
+	resource    string
+	subresource string
+	verbs       []string
+}
+
+// getRequiredPermissions returns permissions used by the controller, patching pods and tapps is not
+// needed in dry run mode.
+func getRequiredPermissions() []requiredPermission {
+	podVerbs := []string{"get", "list", "watch", "patch"}
+	tappVerbs := []string{"get", "list", "watch", "patch"}
+	if getDryRun() {
+		podVerbs = []string{"get", "list", "watch"}
+		tappVerbs = []string{"get", "list", "watch"}
+	}
+	permissions := []requiredPermission{
+		{group: "", resource: "pods", verbs: podVerbs},
+		{group: "", resource: "events", verbs: []string{"create", "patch", "update"}},
+		{group: tappv1.SchemeGroupVersion.Group, resource: "tapps", verbs: tappVerbs},
+	}
+	if getAdoptOrphanPods() && !getDryRun() {
+		// Owner references of adopted pods block owner deletion, which requires updating finalizers of tapps
+		// if OwnerReferencesPermissionEnforcement admission plugin is enabled.
+		permissions = append(permissions, requiredPermission{group: tappv1.SchemeGroupVersion.Group,
+			resource: "tapps", subresource: "finalizers", verbs: []string{"update"}})
+	}
+	return permissions
+}
+
+// Preflight checks that TApp CRD is served by apiserver and the controller has all permissions it needs in
+// namespace(all namespaces if empty), so that the job fails at startup instead of in the middle of updating pods.
+func Preflight(kubeclient kubernetes.Interface, namespace string) error {
+	if err := checkTAppResource(kubeclient); err != nil {
+		return err
+	}
+	var denied []string
+	for _, p := range getRequiredPermissions() {
+		for _, verb := range p.verbs {
+			allowed, err := checkPermission(kubeclient, namespace, p.group, p.resource, p.subresource, verb)
+			if err != nil {
+				return fmt.Errorf("failed to check permission to %s %s: %v", verb,
+					groupResource(p.group, p.resource, p.subresource), err)
+			}
+			if !allowed {
+				denied = append(denied, fmt.Sprintf("%s %s", verb, groupResource(p.group, p.resource, p.subresource)))
+			}
+		}
+	}
+	if len(denied) != 0 {
+		scope := "all namespaces"
+		if namespace != "" {
+			scope = "namespace " + namespace
+		}
+		return fmt.Errorf("permissions denied in %s: %s, grant them to the service account of the job, "+
+			"see job/rbac-namespaced.yaml", scope, strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+func checkTAppResource(kubeclient kubernetes.Interface) error {
+	groupVersion := tappv1.SchemeGroupVersion.String()
+	resources, err := kubeclient.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		return fmt.Errorf("failed to discover %s, is TApp CRD installed? %v", groupVersion, err)
+	}
+	if resources != nil {
+		for _, resource := range resources.APIResources {
+			if resource.Name == "tapps" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("resource tapps is not served in %s, is TApp CRD installed?", groupVersion)
+}
+
+func checkPermission(kubeclient kubernetes.Interface, namespace, group, resource, subresource,
+	verb string) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Group:       group,
+				Resource:    resource,
+				Subresource: subresource,
+				Verb:        verb,
+			},
+		},
+	}
+	result, err := kubeclient.AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+	if err != nil {
+		return false, err
+	}
+	return result.Status.Allowed, nil
+}
+
+func groupResource(group, resource, subresource string) string {
+	if group != "" {
+		resource = resource + "." + group
+	}
+	if subresource != "" {
+		resource = resource + "/" + subresource
+	}
+	return resource
+}
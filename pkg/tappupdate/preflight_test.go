@@ -0,0 +1,91 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tappupdate
+
+import (
+	"strings"
+	"testing"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+func newPreflightClient(withTApp bool, denied ...string) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	if withTApp {
+		client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+			GroupVersion: tappv1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{{Name: "tapps", Namespaced: true, Kind: "TApp"}},
+		}}
+	}
+	client.PrependReactor("create", "selfsubjectaccessreviews",
+		func(action core.Action) (bool, runtime.Object, error) {
+			review := action.(core.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+			attr := review.Spec.ResourceAttributes
+			review.Status.Allowed = true
+			for _, d := range denied {
+				if d == attr.Verb+" "+groupResource(attr.Group, attr.Resource, attr.Subresource) {
+					review.Status.Allowed = false
+				}
+			}
+			return true, review, nil
+		})
+	return client
+}
+
+func TestPreflight(t *testing.T) {
+	if err := Preflight(newPreflightClient(true), "default"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := Preflight(newPreflightClient(false), "default"); err == nil {
+		t.Errorf("Expected error without TApp CRD")
+	}
+
+	err := Preflight(newPreflightClient(true, "patch pods", "patch tapps.apps.tkestack.io"), "default")
+	if err == nil {
+		t.Fatalf("Expected error without permissions")
+	}
+	for _, s := range []string{"patch pods", "patch tapps.apps.tkestack.io", "namespace default"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Expected error %q to contain %q", err.Error(), s)
+		}
+	}
+}
+
+func TestPreflightDryRun(t *testing.T) {
+	defer SetDryRun(false)
+	SetDryRun(true)
+	if err := Preflight(newPreflightClient(true, "patch pods", "patch tapps.apps.tkestack.io"), ""); err != nil {
+		t.Errorf("Unexpected error in dry run mode: %v", err)
+	}
+}
+
+func TestPreflightAdoptOrphanPods(t *testing.T) {
+	defer SetAdoptOrphanPods(false)
+	SetAdoptOrphanPods(true)
+	err := Preflight(newPreflightClient(true, "update tapps.apps.tkestack.io/finalizers"), "default")
+	if err == nil || !strings.Contains(err.Error(), "update tapps.apps.tkestack.io/finalizers") {
+		t.Errorf("Expected error for missing permission to update finalizers of tapps, got %v", err)
+	}
+}
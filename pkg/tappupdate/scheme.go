@@ -0,0 +1,87 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"fmt"
+	"strconv"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tapp/pkg/util"
+	"tkestack.io/tappupdate/pkg/hash"
+
+	"k8s.io/klog"
+)
+
+// invalidHashSchemeError is returned by checkHashScheme if the hash scheme annotation is not a version.
+type invalidHashSchemeError struct {
+	value string
+	err   error
+}
+
+func (e *invalidHashSchemeError) Error() string {
+	return fmt.Sprintf("invalid hash scheme %q: %v", e.value, e.err)
+}
+
+// hashSchemeEventReason returns reason of the event recorded for error returned by checkHashScheme.
+func hashSchemeEventReason(err error) string {
+	if _, ok := err.(*invalidHashSchemeError); ok {
+		return "InvalidHashScheme"
+	}
+	return "HashSchemeTooNew"
+}
+
+// checkHashScheme returns error if hashes of tapp are generated by a newer hash scheme than ours, or the recorded
+// hash scheme is invalid.
+func checkHashScheme(tapp *tappv1.TApp) error {
+	value, ok := tapp.Annotations[hash.SchemeAnnotationKey]
+	if !ok {
+		return nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return &invalidHashSchemeError{value: value, err: err}
+	}
+	if version > hash.SchemeVersion {
+		return fmt.Errorf("hash scheme %d is newer than supported scheme %d", version, hash.SchemeVersion)
+	}
+	return nil
+}
+
+// recordHashScheme records our hash scheme version in tapp's annotations. Only the annotation is sent in a merge
+// patch, so other fields of tapp are kept.
+func (c *Controller) recordHashScheme(tapp *tappv1.TApp) error {
+	expected := strconv.Itoa(hash.SchemeVersion)
+	if tapp.Annotations[hash.SchemeAnnotationKey] == expected {
+		return nil
+	}
+	return c.patchTApp(tapp, func(latest *tappv1.TApp) (map[string]interface{}, error) {
+		if err := checkHashScheme(latest); err != nil {
+			return nil, err
+		}
+		if latest.Annotations[hash.SchemeAnnotationKey] == expected {
+			return nil, nil
+		}
+		klog.V(3).Infof("record hash scheme %s for tapp %s", expected, util.GetTAppFullName(tapp))
+		return map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{hash.SchemeAnnotationKey: expected},
+			},
+		}, nil
+	})
+}
@@ -0,0 +1,115 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	v1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tappupdate/pkg/hash"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	core "k8s.io/client-go/testing"
+)
+
+func TestCheckHashScheme(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		valid       bool
+		reason      string
+	}{
+		{annotations: nil, valid: true},
+		{annotations: map[string]string{hash.SchemeAnnotationKey: strconv.Itoa(hash.SchemeVersion)}, valid: true},
+		{annotations: map[string]string{hash.SchemeAnnotationKey: strconv.Itoa(hash.SchemeVersion + 1)}, valid: false,
+			reason: "HashSchemeTooNew"},
+		{annotations: map[string]string{hash.SchemeAnnotationKey: "invalid"}, valid: false,
+			reason: "InvalidHashScheme"},
+	}
+	for _, test := range tests {
+		tapp := &v1.TApp{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}}
+		err := checkHashScheme(tapp)
+		if (err == nil) != test.valid {
+			t.Errorf("Unexpected result for annotations %v: %v", test.annotations, err)
+		}
+		if err != nil && hashSchemeEventReason(err) != test.reason {
+			t.Errorf("Expected reason %s for annotations %v, got %s", test.reason, test.annotations,
+				hashSchemeEventReason(err))
+		}
+	}
+}
+
+func TestRecordHashScheme(t *testing.T) {
+	tapp := &v1.TApp{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", ResourceVersion: "1"}}
+	latest := tapp.DeepCopy()
+	latest.ResourceVersion = "2"
+	latest.Annotations = map[string]string{"other": "value"}
+	c, _, tappclient := newTestController(nil, latest)
+
+	if err := c.recordHashScheme(tapp); err != nil {
+		t.Fatalf("Failed to record hash scheme: %v", err)
+	}
+	result, err := tappclient.TappcontrollerV1().TApps(tapp.Namespace).Get(tapp.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get tapp: %v", err)
+	}
+	expected := map[string]string{"other": "value", hash.SchemeAnnotationKey: strconv.Itoa(hash.SchemeVersion)}
+	if !reflect.DeepEqual(result.Annotations, expected) {
+		t.Errorf("Expected annotations %v, got %v", expected, result.Annotations)
+	}
+
+	var patches []core.PatchAction
+	for _, action := range tappclient.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("Unexpected update of tapp: %v", action)
+		}
+		if patch, ok := action.(core.PatchAction); ok {
+			patches = append(patches, patch)
+		}
+	}
+	if len(patches) != 1 {
+		t.Fatalf("Expected 1 patch, got %d", len(patches))
+	}
+	if patches[0].GetPatchType() != types.MergePatchType {
+		t.Errorf("Expected merge patch, got %s", patches[0].GetPatchType())
+	}
+	expectedPatch := `{"metadata":{"annotations":{"` + hash.SchemeAnnotationKey + `":"` +
+		strconv.Itoa(hash.SchemeVersion) + `"},"resourceVersion":"2"}}`
+	if string(patches[0].GetPatch()) != expectedPatch {
+		t.Errorf("Expected patch %s, got %s", expectedPatch, patches[0].GetPatch())
+	}
+}
+
+func TestRecordHashSchemeNewerOnLatest(t *testing.T) {
+	tapp := &v1.TApp{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}}
+	// Latest tapp is handled by a newer version of the job after tapp is listed.
+	latest := tapp.DeepCopy()
+	latest.Annotations = map[string]string{hash.SchemeAnnotationKey: strconv.Itoa(hash.SchemeVersion + 1)}
+	c, _, tappclient := newTestController(nil, latest)
+
+	if err := c.recordHashScheme(tapp); err == nil {
+		t.Errorf("Expected error for newer hash scheme on latest tapp")
+	}
+	for _, action := range tappclient.Actions() {
+		if action.GetVerb() == "patch" || action.GetVerb() == "update" {
+			t.Errorf("Unexpected write of tapp: %v", action)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tappupdate
+
+import (
+	"hash/fnv"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+)
+
+var (
+	shardCount = 1
+	shardIndex = 0
+)
+
+// SetShard makes the controller only handle tapps whose shard is index of count shards, so tapps of a very large
+// cluster can be split among multiple jobs, each started with a different index.
+func SetShard(count, index int) {
+	shardCount = count
+	shardIndex = index
+}
+
+func getShard() (count, index int) {
+	return shardCount, shardIndex
+}
+
+// inShard returns whether tapp is handled by this job. A tapp is assigned to the shard of the hash of its
+// namespace/name modulo shard count, so the assignment doesn't change between runs.
+func inShard(tapp *tappv1.TApp) bool {
+	count, index := getShard()
+	if count <= 1 {
+		return true
+	}
+	return shardOf(tapp.Namespace+"/"+tapp.Name, count) == index
+}
+
+func shardOf(key string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(count))
+}
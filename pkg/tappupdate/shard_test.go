@@ -0,0 +1,50 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package tappupdate
+
+import (
+	"strconv"
+	"testing"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestInShard(t *testing.T) {
+	defer SetShard(1, 0)
+
+	const count = 3
+	for i := 0; i < 100; i++ {
+		tapp := &tappv1.TApp{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tapp-" + strconv.Itoa(i)}}
+		owners := 0
+		for index := 0; index < count; index++ {
+			SetShard(count, index)
+			if inShard(tapp) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			t.Errorf("Expected tapp %s/%s to be in exactly 1 shard, got %d", tapp.Namespace, tapp.Name, owners)
+		}
+	}
+
+	SetShard(1, 0)
+	if !inShard(&tappv1.TApp{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tapp"}}) {
+		t.Errorf("Expected all tapps to be handled without sharding")
+	}
+}
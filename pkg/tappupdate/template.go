@@ -0,0 +1,135 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"fmt"
+	"strings"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tapp/pkg/util"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+// gcTemplatePool deletes templatePool entries that are not referenced by any instance and whose
+// template hash is not carried by any pod. Hashes of tapp's templates must have been updated.
+func (c *Controller) gcTemplatePool(tapp *tappv1.TApp) error {
+	unused, err := c.getUnusedTemplates(tapp)
+	if err != nil || len(unused) == 0 {
+		return err
+	}
+	if isDryRun(tapp) {
+		klog.Infof("[dry-run] tapp %s, unused templates will be deleted: %v", util.GetTAppFullName(tapp), unused)
+		return nil
+	}
+	return c.deleteTemplates(tapp, unused)
+}
+
+// getUnusedTemplates returns names of templatePool entries which are not used by any instance or pod.
+func (c *Controller) getUnusedTemplates(tapp *tappv1.TApp) ([]string, error) {
+	referenced := getReferencedTemplates(&tapp.Spec)
+	unused := sets.NewString()
+	for name, template := range tapp.Spec.TemplatePool {
+		if referenced.Has(name) {
+			continue
+		}
+		used, err := c.isTemplateHashUsed(tapp, c.tappHash.GetTemplateHash(template.Labels))
+		if err != nil {
+			return nil, err
+		}
+		if !used {
+			unused.Insert(name)
+		}
+	}
+	return unused.List(), nil
+}
+
+// isTemplateHashUsed returns true if any pod of tapp carries templateHash.
+func (c *Controller) isTemplateHashUsed(tapp *tappv1.TApp, templateHash string) (bool, error) {
+	pods, err := podsByIndex(c.podIndexer, podTemplateHashIndex, templateHashIndexKey(tapp.Namespace, templateHash))
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range pods {
+		if controllerRef := metav1.GetControllerOf(pod); controllerRef != nil && controllerRef.UID == tapp.UID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getReferencedTemplates returns names of templates referenced by instances.
+func getReferencedTemplates(spec *tappv1.TAppSpec) sets.String {
+	referenced := sets.NewString(spec.DefaultTemplateName)
+	for _, name := range spec.Templates {
+		referenced.Insert(name)
+	}
+	return referenced
+}
+
+// deleteTemplates deletes templates from latest tapp's templatePool, templates that become referenced
+// in the meantime are kept. Only the deleted entries are sent in a merge patch, so fields of tapp unknown to us
+// are kept.
+func (c *Controller) deleteTemplates(tapp *tappv1.TApp, names []string) error {
+	return c.patchTApp(tapp, func(latest *tappv1.TApp) (map[string]interface{}, error) {
+		referenced := getReferencedTemplates(&latest.Spec)
+		deleted := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			if _, ok := latest.Spec.TemplatePool[name]; ok && !referenced.Has(name) {
+				// null deletes the entry in a merge patch.
+				deleted[name] = nil
+			}
+		}
+		if len(deleted) == 0 {
+			return nil, nil
+		}
+		klog.V(3).Infof("delete unused templates %v from tapp %s", sets.StringKeySet(deleted).List(),
+			util.GetTAppFullName(tapp))
+		return map[string]interface{}{
+			"spec": map[string]interface{}{"templatePool": deleted},
+		}, nil
+	})
+}
+
+// validateTemplateReferences checks that templates of instances with ids exist in templatePool, it returns ids of
+// instances whose template is missing.
+func validateTemplateReferences(spec *tappv1.TAppSpec, ids sets.String) (sets.String, error) {
+	invalid := sets.NewString()
+	missing := make(map[string][]string)
+	for _, id := range ids.List() {
+		name := getPodTemplateName(spec.Templates, id, spec.DefaultTemplateName)
+		if name == tappv1.DefaultTemplateName {
+			continue
+		}
+		if _, ok := spec.TemplatePool[name]; !ok {
+			invalid.Insert(id)
+			missing[name] = append(missing[name], id)
+		}
+	}
+	if len(missing) == 0 {
+		return invalid, nil
+	}
+	var names []string
+	for _, name := range sets.StringKeySet(missing).List() {
+		names = append(names, fmt.Sprintf("%q(instances %s)", name, formatInstanceIds(missing[name])))
+	}
+	return invalid, fmt.Errorf("templates not found in templatePool: %s", strings.Join(names, ", "))
+}
@@ -0,0 +1,146 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	pkgtesting "tkestack.io/tappupdate/pkg/testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	core "k8s.io/client-go/testing"
+)
+
+func TestValidateTemplateReferences(t *testing.T) {
+	spec := &v1.TAppSpec{
+		DefaultTemplateName: v1.DefaultTemplateName,
+		TemplatePool:        map[string]corev1.PodTemplateSpec{"test": {}},
+		// Instance 9 is not running, its missing template is ignored.
+		Templates: map[string]string{"1": "test", "2": v1.DefaultTemplateName, "9": "missing"},
+	}
+	ids := sets.NewString("0", "1", "2", "3")
+	if invalid, err := validateTemplateReferences(spec, ids); err != nil || invalid.Len() != 0 {
+		t.Errorf("Expected valid templates, got invalid instances %v, error: %v", invalid.List(), err)
+	}
+
+	spec.Templates["3"] = "missing"
+	invalid, err := validateTemplateReferences(spec, ids)
+	if err == nil {
+		t.Errorf("Expected error for missing template of instance 3")
+	}
+	if expected := []string{"3"}; !reflect.DeepEqual(invalid.List(), expected) {
+		t.Errorf("Expected invalid instances %v, got %v", expected, invalid.List())
+	}
+
+	delete(spec.Templates, "3")
+	spec.DefaultTemplateName = "missing"
+	invalid, err = validateTemplateReferences(spec, ids)
+	if err == nil {
+		t.Errorf("Expected error for missing default template")
+	}
+	if expected := []string{"0", "3"}; !reflect.DeepEqual(invalid.List(), expected) {
+		t.Errorf("Expected invalid instances %v, got %v", expected, invalid.List())
+	}
+}
+
+func TestGetUnusedTemplates(t *testing.T) {
+	tapp := pkgtesting.NewTApp("default", "test", 2, createTemplate("default"))
+	pkgtesting.AddTemplate(tapp, "referenced", createTemplate("referenced"), "1")
+	pkgtesting.AddTemplate(tapp, "running", createTemplate("running"))
+	pkgtesting.AddTemplate(tapp, "unused", createTemplate("unused"))
+
+	// Instance 0 was switched from template "running" to the default template, its pod is not recreated yet.
+	previous := tapp.DeepCopy()
+	previous.Spec.Templates["0"] = "running"
+	runningPod := mustNewPod(t, previous, "0")
+	// Pod of another tapp with the same template hash does not make the template used.
+	other := pkgtesting.NewTApp("default", "other", 1, createTemplate("unused"))
+	otherPod := mustNewPod(t, other, "0")
+	c, _, _ := newTestController([]*corev1.Pod{runningPod, otherPod})
+
+	unused, err := c.getUnusedTemplates(tapp)
+	if err != nil {
+		t.Fatalf("Failed to get unused templates: %v", err)
+	}
+	if expected := []string{"unused"}; !reflect.DeepEqual(unused, expected) {
+		t.Errorf("Failed to get unused templates, expected %v, got %v", expected, unused)
+	}
+}
+
+func TestDeleteTemplates(t *testing.T) {
+	tapp := pkgtesting.NewTApp("default", "test", 4, createTemplate("default"))
+	tapp.ResourceVersion = "1"
+	pkgtesting.AddTemplate(tapp, "unused", createTemplate("unused"))
+	pkgtesting.AddTemplate(tapp, "referenced", createTemplate("referenced"))
+	// Template "referenced" becomes referenced after tapp is listed.
+	latest := tapp.DeepCopy()
+	latest.Spec.Templates["3"] = "referenced"
+	c, _, tappclient := newTestController(nil, latest)
+
+	if err := c.deleteTemplates(tapp, []string{"referenced", "unused"}); err != nil {
+		t.Fatalf("Failed to delete templates: %v", err)
+	}
+	result, err := tappclient.TappcontrollerV1().TApps(tapp.Namespace).Get(tapp.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get tapp: %v", err)
+	}
+	if _, ok := result.Spec.TemplatePool["unused"]; ok {
+		t.Errorf("Expected template unused to be deleted")
+	}
+	if _, ok := result.Spec.TemplatePool["referenced"]; !ok {
+		t.Errorf("Expected template referenced to be kept")
+	}
+
+	var patches []core.PatchAction
+	for _, action := range tappclient.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("Unexpected update of tapp: %v", action)
+		}
+		if patch, ok := action.(core.PatchAction); ok {
+			patches = append(patches, patch)
+		}
+	}
+	if len(patches) != 1 {
+		t.Fatalf("Expected 1 patch, got %d", len(patches))
+	}
+	if patches[0].GetPatchType() != types.MergePatchType {
+		t.Errorf("Expected merge patch, got %s", patches[0].GetPatchType())
+	}
+	expected := `{"metadata":{"resourceVersion":"1"},"spec":{"templatePool":{"unused":null}}}`
+	if string(patches[0].GetPatch()) != expected {
+		t.Errorf("Expected patch %s, got %s", expected, patches[0].GetPatch())
+	}
+}
+
+// createTemplate returns a template whose label and image are name, its hashes are not set.
+func createTemplate(name string) corev1.PodTemplateSpec {
+	return pkgtesting.NewTemplate(map[string]string{"template": name}, name)
+}
+
+func mustNewPod(t testing.TB, tapp *v1.TApp, id string) *corev1.Pod {
+	pod, err := pkgtesting.NewPod(tapp, id)
+	if err != nil {
+		t.Fatalf("Failed to create pod of instance %s: %v", id, err)
+	}
+	return pod
+}
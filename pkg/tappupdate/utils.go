@@ -19,10 +19,14 @@ package tappupdate
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 
 	v1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
 	client "k8s.io/client-go/kubernetes/typed/core/v1"
 )
@@ -71,3 +75,57 @@ func getPodTemplateName(templates map[string]string, podId string, defaultTempla
 		return name
 	}
 }
+
+// sortInstanceIds sorts instance ids in numerical order.
+func sortInstanceIds(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, errA := strconv.Atoi(ids[i])
+		b, errB := strconv.Atoi(ids[j])
+		if errA != nil || errB != nil {
+			return ids[i] < ids[j]
+		}
+		return a < b
+	})
+}
+
+// getPausedInstances returns ids of instances that are paused by pausedInstancesAnnotation.
+func getPausedInstances(tapp *v1.TApp) sets.String {
+	paused := sets.NewString()
+	for _, id := range strings.Split(tapp.Annotations[pausedInstancesAnnotation], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			paused.Insert(id)
+		}
+	}
+	return paused
+}
+
+// copyTAppTemplates returns a shallow copy of tapp, only labels of its templates are copied, so hashes can be
+// set into them without modifying the cached tapp. Other fields of the copy must not be modified.
+func copyTAppTemplates(tapp *v1.TApp) *v1.TApp {
+	cp := *tapp
+	cp.Spec.Template.Labels = copyLabels(tapp.Spec.Template.Labels)
+	if tapp.Spec.TemplatePool != nil {
+		cp.Spec.TemplatePool = make(map[string]corev1.PodTemplateSpec, len(tapp.Spec.TemplatePool))
+		for name, template := range tapp.Spec.TemplatePool {
+			template.Labels = copyLabels(template.Labels)
+			cp.Spec.TemplatePool[name] = template
+		}
+	}
+	return &cp
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(labels))
+	for k, v := range labels {
+		cp[k] = v
+	}
+	return cp
+}
+
+// labelPath returns JSON pointer of label key in object, "~" and "/" in key are escaped as RFC 6901 requires.
+func labelPath(key string) string {
+	return "/metadata/labels/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,59 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package tappupdate
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSortInstanceIds(t *testing.T) {
+	ids := []string{"10", "2", "1", "0", "21"}
+	sortInstanceIds(ids)
+	expected := []string{"0", "1", "2", "10", "21"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Failed to sort instance ids, expected %v, got %v", expected, ids)
+	}
+}
+
+func TestGetPausedInstances(t *testing.T) {
+	tapp := &v1.TApp{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{pausedInstancesAnnotation: "1, 3,,7"},
+		},
+	}
+	paused := getPausedInstances(tapp)
+	expected := []string{"1", "3", "7"}
+	if !reflect.DeepEqual(paused.List(), expected) {
+		t.Errorf("Failed to get paused instances, expected %v, got %v", expected, paused.List())
+	}
+
+	if paused := getPausedInstances(&v1.TApp{}); paused.Len() != 0 {
+		t.Errorf("Expected no paused instances, got %v", paused.List())
+	}
+}
+
+func TestLabelPath(t *testing.T) {
+	if path := labelPath("tkestack.io/a~b"); path != "/metadata/labels/tkestack.io~1a~0b" {
+		t.Errorf("Failed to escape label key, got %s", path)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+// Package testing provides builders of TApp and pod fixtures, whose hash labels are the same as those set by tapp
+// controller, so tools built around TApp can be tested without a cluster.
+package testing
+
+import (
+	"fmt"
+	"strconv"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tappupdate/pkg/hash"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// NewTemplate returns a template with labels, which runs a container named "main" with image.
+func NewTemplate(labels map[string]string, image string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: copyLabels(labels)},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "main", Image: image}}},
+	}
+}
+
+// NewTApp returns a tapp with replicas instances running template, hashes of template are set into its labels.
+func NewTApp(namespace, name string, replicas int, template corev1.PodTemplateSpec) *tappv1.TApp {
+	tapp := &tappv1.TApp{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: tappv1.SchemeGroupVersion.String(),
+			Kind:       "TApp",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			UID:       types.UID(namespace + "/" + name),
+		},
+		Spec: tappv1.TAppSpec{
+			Replicas:            int32(replicas),
+			Selector:            &metav1.LabelSelector{MatchLabels: copyLabels(template.Labels)},
+			Template:            *template.DeepCopy(),
+			TemplatePool:        map[string]corev1.PodTemplateSpec{},
+			Templates:           map[string]string{},
+			Statuses:            map[string]tappv1.InstanceStatus{},
+			DefaultTemplateName: tappv1.DefaultTemplateName,
+		},
+	}
+	setHashes(&tapp.Spec.Template)
+	return tapp
+}
+
+// AddTemplate adds template into tapp's templatePool with hashes set, and makes instances with ids use it.
+func AddTemplate(tapp *tappv1.TApp, templateName string, template corev1.PodTemplateSpec, ids ...string) {
+	template = *template.DeepCopy()
+	setHashes(&template)
+	tapp.Spec.TemplatePool[templateName] = template
+	for _, id := range ids {
+		tapp.Spec.Templates[id] = templateName
+	}
+}
+
+// NewPod returns the running pod of instance id created by tapp controller, from the template of the instance.
+func NewPod(tapp *tappv1.TApp, id string) (*corev1.Pod, error) {
+	template, err := getInstanceTemplate(tapp, id)
+	if err != nil {
+		return nil, err
+	}
+	template = template.DeepCopy()
+	labels := copyLabels(template.Labels)
+	labels[tappv1.TAppInstanceKey] = id
+	return &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   tapp.Namespace,
+			Name:        fmt.Sprintf("%s-%s", tapp.Name, id),
+			UID:         types.UID(tapp.Namespace + "/" + tapp.Name + "-" + id),
+			Labels:      labels,
+			Annotations: template.Annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(tapp, tappv1.SchemeGroupVersion.WithKind("TApp")),
+			},
+		},
+		Spec:   template.Spec,
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}, nil
+}
+
+// NewPods returns pods of all instances of tapp.
+func NewPods(tapp *tappv1.TApp) ([]*corev1.Pod, error) {
+	pods := make([]*corev1.Pod, 0, tapp.Spec.Replicas)
+	for i := 0; i < int(tapp.Spec.Replicas); i++ {
+		pod, err := NewPod(tapp, strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// setHashes sets hashes into template's labels as tapp controller does when it syncs tapp, until they are stable.
+// Spec hash label is part of template hash, so template hash changes once more after spec hash is set into labels.
+func setHashes(template *corev1.PodTemplateSpec) {
+	tappHash := hash.NewTappHash()
+	hash.UpdateHashes(tappHash, template)
+	hash.UpdateHashes(tappHash, template)
+}
+
+func getInstanceTemplate(tapp *tappv1.TApp, id string) (*corev1.PodTemplateSpec, error) {
+	name, ok := tapp.Spec.Templates[id]
+	if !ok {
+		name = tapp.Spec.DefaultTemplateName
+	}
+	if name == "" || name == tappv1.DefaultTemplateName {
+		return &tapp.Spec.Template, nil
+	}
+	template, ok := tapp.Spec.TemplatePool[name]
+	if !ok {
+		return nil, fmt.Errorf("template %s of instance %s is not found in templatePool", name, id)
+	}
+	return &template, nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack available.
+ *
+ * Copyright (C) 2012-2019 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package testing
+
+import (
+	"reflect"
+	"testing"
+
+	tappv1 "tkestack.io/tapp/pkg/apis/tappcontroller/v1"
+	"tkestack.io/tappupdate/pkg/hash"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func createTemplate(image string) corev1.PodTemplateSpec {
+	return NewTemplate(map[string]string{"app": "test"}, image)
+}
+
+func TestNewPods(t *testing.T) {
+	tapp := NewTApp("default", "test", 3, createTemplate("nginx:1"))
+	AddTemplate(tapp, "canary", createTemplate("nginx:2"), "2")
+	pods, err := NewPods(tapp)
+	if err != nil {
+		t.Fatalf("Failed to create pods: %v", err)
+	}
+	if len(pods) != 3 {
+		t.Fatalf("Expected 3 pods, got %d", len(pods))
+	}
+
+	th := hash.NewTappHash()
+	for i, template := range []corev1.PodTemplateSpec{tapp.Spec.Template, tapp.Spec.Template, tapp.Spec.TemplatePool["canary"]} {
+		pod := pods[i]
+		if pod.Spec.Containers[0].Image != template.Spec.Containers[0].Image {
+			t.Errorf("Pod %s runs image %s, expected %s", pod.Name, pod.Spec.Containers[0].Image,
+				template.Spec.Containers[0].Image)
+		}
+		for _, key := range []string{hash.TemplateHashKey, hash.UniqHashKey, hash.SpecHashKey} {
+			if pod.Labels[key] == "" || pod.Labels[key] != template.Labels[key] {
+				t.Errorf("Pod %s has label %s=%q, expected %q", pod.Name, key, pod.Labels[key], template.Labels[key])
+			}
+		}
+		if pod.Labels[tappv1.TAppInstanceKey] == "" {
+			t.Errorf("Pod %s has no instance id label", pod.Name)
+		}
+		if ref := metav1.GetControllerOf(pod); ref == nil || ref.UID != tapp.UID {
+			t.Errorf("Pod %s is not controlled by tapp", pod.Name)
+		}
+	}
+	if th.GetTemplateHash(pods[0].Labels) == th.GetTemplateHash(pods[2].Labels) {
+		t.Errorf("Expected pods of different templates to have different template hashes")
+	}
+}
+
+func TestNewPodWithMissingTemplate(t *testing.T) {
+	tapp := NewTApp("default", "test", 1, createTemplate("nginx:1"))
+	tapp.Spec.Templates["0"] = "missing"
+	if _, err := NewPod(tapp, "0"); err == nil {
+		t.Errorf("Expected error for instance with missing template")
+	}
+}
+
+func TestHashesAreStable(t *testing.T) {
+	tapp := NewTApp("default", "test", 1, createTemplate("nginx:1"))
+	template := tapp.Spec.Template.DeepCopy()
+	// Syncing the tapp again doesn't change its hashes.
+	hash.UpdateHashes(hash.NewTappHash(), template)
+	if !reflect.DeepEqual(template.Labels, tapp.Spec.Template.Labels) {
+		t.Errorf("Expected hashes to be stable, got %v, expected %v", template.Labels, tapp.Spec.Template.Labels)
+	}
+}